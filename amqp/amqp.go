@@ -5,27 +5,99 @@ import (
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/streadway/amqp"
 	"os"
-	"strconv"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/trustnetworks/analytics-common/broker"
 	"github.com/trustnetworks/analytics-common/utils"
 )
 
 type AMQPSession struct {
-	*amqp.Channel
+	Channel
+	Connection
+}
+
+// Channel is the part of an AMQP channel which clients use, so that tests
+// can stand in for the broker.
+type Channel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueueUnbind(name, key, exchange string, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Ack(tag uint64, multiple bool) error
+	Confirm(noWait bool) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	NotifyCancel(c chan string) chan string
+	Close() error
+}
+
+// Connection is the part of an AMQP connection which clients use.
+type Connection interface {
+	Channel() (Channel, error)
+	NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking
+	Close() error
+}
+
+var _ Channel = (*amqp.Channel)(nil)
+
+// connection adapts a connection to the broker to Connection
+type connection struct {
 	*amqp.Connection
 }
 
+func (c connection) Channel() (Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
 type AMQPClient struct {
 	Broker   string
 	Exchange string
+	// Type the exchange is declared with, fanout if unset
+	ExchangeType string
+
+	// Retrying while the broker cannot be reached
+	Backoff Backoff
+	// Connecting over TLS, if set
+	TLS *TLSConfig
+	// Leave the exchange for the consumer to verify, rather than declaring
+	// it
+	Passive bool
+
 	sessions chan chan AMQPSession
+	// Opens connections in place of dialling Broker, if set
+	dialer func() (Connection, error)
 }
 
 type AMQPPublisher struct {
 	AMQPClient
+
+	// Routing key for messages published without one of their own
+	RoutingKey string
+
+	// Maximum number of messages published but not yet confirmed
+	MaxInFlight int
+
+	// When above one, up to BatchSize messages are packed into each AMQP
+	// message, waiting up to BatchLinger for a batch to fill.
+	BatchSize   int
+	BatchLinger time.Duration
 }
 
 type AMQPConsumer struct {
@@ -38,9 +110,73 @@ type AMQPConsumer struct {
 	Persistent      bool
 	AckThreshold    int
 
+	// Filters on the messages received from Exchange, every message if
+	// there are none
+	Bindings []Binding
+
+	// Arguments for a sharded queue
+	Queue QueueOptions
+	// Check the exchanges and queues exist as declared, rather than
+	// declaring them
+	Verify bool
+
+	// Queue receiving messages dead-lettered MaxDeaths times, which would
+	// otherwise cycle between the replica queues and the DLQ for ever
+	ParkingLot string
+	MaxDeaths  int
+
+	// When set, messages are acknowledged in batches as they arrive, before
+	// they have been handled, and the deliveries need not be settled.
+	BatchAck bool
+
 	ctx context.Context
 }
 
+// delivery settles a single message on the channel it arrived on
+type delivery struct {
+	msg    amqp.Delivery
+	ts     time.Time
+	env    broker.Envelope
+	manual bool
+}
+
+func (d *delivery) Body() []byte {
+	return d.msg.Body
+}
+
+func (d *delivery) Timestamp() time.Time {
+	return d.ts
+}
+
+func (d *delivery) Envelope() broker.Envelope {
+	return d.env
+}
+
+func (d *delivery) Key() string {
+	return d.msg.RoutingKey
+}
+
+func (d *delivery) Ack() error {
+	if !d.manual {
+		return nil
+	}
+	return d.msg.Ack(false)
+}
+
+func (d *delivery) Nack() error {
+	if !d.manual {
+		return nil
+	}
+	return d.msg.Nack(false, true)
+}
+
+func (d *delivery) Reject() error {
+	if !d.manual {
+		return nil
+	}
+	return d.msg.Reject(false)
+}
+
 func (s AMQPSession) Close() error {
 	if s.Connection == nil {
 		return nil
@@ -48,14 +184,71 @@ func (s AMQPSession) Close() error {
 	return s.Connection.Close()
 }
 
-// redial continually connects to the URL, exiting the program when no longer possible
-func redial(ctx context.Context, url string, exchange string) chan chan AMQPSession {
+// open connects to the broker, or through the client's dialer if it has one
+func (c *AMQPClient) open() (Connection, error) {
+	if c.dialer != nil {
+		return c.dialer()
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	return connection{conn}, nil
+}
+
+// connect opens a channel to the broker and declares the client's exchange
+func (c *AMQPClient) connect() (AMQPSession, error) {
+	conn, err := c.open()
+	if err != nil {
+		return AMQPSession{}, fmt.Errorf("cannot (re)dial: %v", err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return AMQPSession{}, fmt.Errorf("cannot create channel: %v", err)
+	}
+
+	if c.Passive {
+		return AMQPSession{ch, conn}, nil
+	}
+
+	kind := c.ExchangeType
+	if kind == "" {
+		kind = "fanout"
+	}
+	if err := ch.ExchangeDeclare(
+		c.Exchange, // name
+		kind,       // type
+		true,       // durable
+		false,      // auto-deleted
+		false,      // internal
+		false,      // no-wait
+		nil,        // arguments
+	); err != nil {
+		conn.Close()
+		return AMQPSession{}, fmt.Errorf("cannot declare %s exchange: %v", kind, err)
+	}
+
+	return AMQPSession{ch, conn}, nil
+}
+
+// redial continually connects to the broker, retrying with the client's
+// Backoff while it cannot be reached. The sessions run out, leaving the
+// program to exit, only if it stays unreachable beyond Backoff.MaxElapsed.
+// The client's settings are read as each session is requested, so they can
+// be changed until the client is first used.
+func redial(ctx context.Context, c *AMQPClient, role string) chan chan AMQPSession {
 	sessions := make(chan chan AMQPSession)
 
 	go func() {
 		sess := make(chan AMQPSession)
 		defer close(sess)
 
+		labels := prometheus.Labels{"exchange": c.Exchange, "role": role}
+		connected.With(labels).Set(0)
+		defer connected.With(labels).Set(0)
+
 		for {
 			select {
 			case sessions <- sess:
@@ -64,35 +257,36 @@ func redial(ctx context.Context, url string, exchange string) chan chan AMQPSess
 				return
 			}
 
-			conn, err := amqp.Dial(url)
-			if err != nil {
-				utils.Log("amqp: cannot (re)dial: %v: %q", err, url)
-				return
-			}
+			// Asked for a new session, the last one has gone
+			connected.With(labels).Set(0)
 
-			ch, err := conn.Channel()
-			if err != nil {
-				utils.Log("amqp: cannot create channel: %v", err)
-				return
-			}
+			start := time.Now()
+			session, err := c.connect()
+			for attempt := 0; err != nil; attempt++ {
+				if c.Backoff.MaxElapsed > 0 && time.Since(start) > c.Backoff.MaxElapsed {
+					utils.Log("amqp: giving up connecting for %s after %s: %v", c.Exchange, time.Since(start), err)
+					return
+				}
 
-			if err := ch.ExchangeDeclare(
-				exchange, // name
-				"fanout", // type
-				true,     // durable
-				false,    // auto-deleted
-				false,    // internal
-				false,    // no-wait
-				nil,      // arguments
-			); err != nil {
-				utils.Log("amqp: cannot declare fanout exchange: %v", err)
-				return
+				delay := c.Backoff.Delay(attempt)
+				utils.Log("amqp: %v, retrying %s in %s", err, c.Exchange, delay)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					utils.Log("amqp: shutting down session factory")
+					return
+				}
+
+				reconnectAttempts.With(labels).Inc()
+				session, err = c.connect()
 			}
+			connected.With(labels).Set(1)
 
 			select {
-			case sess <- AMQPSession{ch, conn}:
+			case sess <- session:
 			case <-ctx.Done():
 				utils.Log("amqp: shutting down new session")
+				session.Close()
 				return
 			}
 		}
@@ -101,13 +295,18 @@ func redial(ctx context.Context, url string, exchange string) chan chan AMQPSess
 	return sessions
 }
 
-// Return a new object that can be used to publish to a fanout exchange.
+// Return a new object that can be used to publish to a fanout exchange. Set
+// ExchangeType and RoutingKey before first use to publish to a topic or
+// direct exchange instead.
 func NewPublisher(ctx context.Context, exchange string, broker string) *AMQPPublisher {
 	p := new(AMQPPublisher)
 	p.Broker = broker
 	p.Exchange = exchange
+	p.MaxInFlight = DefaultMaxInFlight
+
+	p.Backoff = DefaultBackoff
 
-	p.sessions = redial(ctx, p.Broker, p.Exchange)
+	p.sessions = redial(ctx, &p.AMQPClient, "publisher")
 
 	return p
 }
@@ -132,9 +331,11 @@ func NewConsumer(ctx context.Context, name string, exchange string, broker strin
 	c.QueueName = name
 	c.Exchange = exchange
 	c.Prefetch = prefetch
-	c.sessions = redial(ctx, c.Broker, c.Exchange)
+	c.Backoff = DefaultBackoff
+	c.sessions = redial(ctx, &c.AMQPClient, "consumer")
 	c.Persistent = persistent
 	c.AckThreshold = 100
+	c.Queue = DefaultQueueOptions
 	c.ctx = ctx
 
 	return c
@@ -166,73 +367,199 @@ func NewShardedConsumer(ctx context.Context, name string, exchange string, broke
 	c.ShardedExchange = name
 	c.DLExchange = fmt.Sprintf("%s-dlx", name)
 	c.DLQName = fmt.Sprintf("%s-dlq", name)
+	c.ParkingLot = fmt.Sprintf("%s-parking-lot", name)
+	c.MaxDeaths = DefaultMaxDeaths
 
 	return c
 }
 
-// publish publishes messages to a reconnecting session to a fanout exchange.
-// It receives from the application specific source of messages.
-func (p *AMQPPublisher) Publish(messages <-chan []byte) error {
-	for session := range p.sessions {
-		var (
-			running bool
-			reading = messages
-			pending = make(chan []byte, 1)
-			confirm = make(chan amqp.Confirmation, 1)
-		)
+// Maximum number of unconfirmed messages for a new publisher
+const DefaultMaxInFlight = 1
+
+// Set the maximum number of messages published but not yet confirmed by the
+// broker. Above one, messages are pipelined rather than each waiting on the
+// confirmation of the last.
+func (p *AMQPPublisher) SetMaxInFlight(max int) {
+	if max < 1 {
+		max = 1
+	}
+	p.MaxInFlight = max
+}
+
+// Publish to a topic or direct exchange, with key as the routing key for
+// messages which do not carry their own.
+func (p *AMQPPublisher) SetRouting(kind string, key string) {
+	p.ExchangeType = kind
+	p.RoutingKey = key
+}
 
+// Pack up to size messages into each AMQP message, waiting up to linger for
+// a batch to fill. Consumers unpack batches before handling them.
+func (p *AMQPPublisher) SetBatching(size int, linger time.Duration) {
+	p.BatchSize = size
+	p.BatchLinger = linger
+}
+
+// publish publishes messages to a reconnecting session to an exchange. It
+// receives from the application specific source of messages, each routed
+// with its own key or, failing that, the publisher's RoutingKey.
+//
+// Messages are tracked by delivery tag until the broker confirms them.
+// Those nacked by the broker, and those unconfirmed when the session is
+// lost, are published again, so every message is delivered at least once.
+// While the broker blocks the connection for flow control, nothing is
+// published or read, leaving senders to see the backlog.
+// It returns nil once the channel is closed and everything read from it has
+// been confirmed.
+func (p *AMQPPublisher) Publish(messages <-chan broker.Message) error {
+	max := p.MaxInFlight
+	if max < 1 {
+		max = 1
+	}
+
+	// Messages, or batches of them, to publish again before reading more
+	var retry []publishing
+	finished := false
+
+	// Headers exchanges route each message on its own headers, so messages
+	// are never batched for them
+	headers := p.ExchangeType == "headers"
+	size := p.BatchSize
+	if headers {
+		size = 0
+	}
+	reading := batch(messages, size, p.BatchLinger)
+
+	for session := range p.sessions {
 		pub, ok := <-session
 		if !ok {
 			break
 		}
+
+		// Large enough that the library never blocks handing over confirms
+		confirm := make(chan amqp.Confirmation, max)
+		confirms := true
 		// publisher confirms for this channel/connection
 		if err := pub.Confirm(false); err != nil {
-			utils.Log("amqp: publisher confirms not supported")
-			close(confirm) // confirms not supported, simulate by always nacking
+			utils.Log("amqp: publisher confirms not supported, publishing to %s unconfirmed: %v", p.Exchange, err)
+			confirms = false
 		} else {
 			pub.NotifyPublish(confirm)
 		}
+		closed := pub.Channel.NotifyClose(make(chan *amqp.Error, 1))
+		blocking := pub.Connection.NotifyBlocked(make(chan amqp.Blocking, 1))
+		isBlocked := false
+		blockedLabels := prometheus.Labels{"exchange": p.Exchange}
+
+		// Unconfirmed messages by delivery tag, which counts from 1 on each
+		// channel
+		outstanding := make(map[uint64]publishing)
+		var tag uint64
+
+		publish := func(out publishing) error {
+			msg := out.message(time.Now())
+			if headers {
+				// Read once, and kept for publishing again
+				if out.headers == nil {
+					out.headers = routingHeaders(out.body, out.env.ContentEncoding)
+				}
+				for name, value := range out.headers {
+					msg.Headers[name] = value
+				}
+			}
+			key := out.key
+			if key == "" {
+				key = p.RoutingKey
+			}
+			if err := pub.Publish(p.Exchange, key, false, false, msg); err != nil {
+				return err
+			}
+			if confirms {
+				tag++
+				outstanding[tag] = out
+			}
+			return nil
+		}
 
 		utils.Log("amqp: publishing events to: %s", p.Exchange)
 
 	Pub:
 		for {
-			var body []byte
+			for !isBlocked && len(retry) > 0 && len(outstanding) < max {
+				if err := publish(retry[0]); err != nil {
+					break Pub
+				}
+				retry = retry[1:]
+			}
+
+			// all messages consumed and confirmed
+			if finished && len(retry) == 0 && len(outstanding) == 0 {
+				pub.Close()
+				return nil
+			}
+
+			// work on pending deliveries until there is room in the window
+			next := reading
+			if isBlocked || finished || len(retry) > 0 || len(outstanding) >= max {
+				next = nil
+			}
+
 			select {
+			case b := <-blocking:
+				if b.Active {
+					utils.Log("amqp: broker blocked publishing to %s: %s", p.Exchange, b.Reason)
+					blocked.With(blockedLabels).Set(1)
+				} else {
+					utils.Log("amqp: broker unblocked publishing to %s", p.Exchange)
+					blocked.With(blockedLabels).Set(0)
+				}
+				isBlocked = b.Active
+
 			case confirmed, ok := <-confirm:
 				if !ok {
 					break Pub
 				}
+				out := outstanding[confirmed.DeliveryTag]
+				delete(outstanding, confirmed.DeliveryTag)
 				if !confirmed.Ack {
-					utils.Log("amqp: nack message %d, body: %q", confirmed.DeliveryTag, string(body))
-				}
-				reading = messages
-
-			case body = <-pending:
-				err := pub.Publish(p.Exchange, "", false, false, amqp.Publishing{
-					ContentType: "text/plain",
-					Body:        body,
-					Headers: amqp.Table{
-						"timestamp_in_ns": strconv.FormatInt(time.Now().UnixNano(), 10),
-					},
-				})
-				// Retry failed delivery on the next session
-				if err != nil {
-					pending <- body
-					pub.Close()
-					break Pub
+					utils.Log("amqp: nack message %d from %s, republishing", confirmed.DeliveryTag, p.Exchange)
+					retry = append(retry, out)
 				}
 
-			case body, running = <-reading:
-				// all messages consumed
+			case <-closed:
+				break Pub
+
+			case out, running := <-next:
 				if !running {
-					return nil
+					finished = true
+					break
+				}
+				// Retry failed delivery on the next session
+				if err := publish(out); err != nil {
+					retry = append(retry, out)
+					break Pub
 				}
-				// work on pending delivery until ack'd
-				pending <- body
-				reading = nil
 			}
 		}
+
+		// Everything unconfirmed goes out again, in order, on the next session
+		tags := make([]uint64, 0, len(outstanding))
+		for t := range outstanding {
+			tags = append(tags, t)
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+		lost := make([]publishing, 0, len(tags)+len(retry))
+		for _, t := range tags {
+			lost = append(lost, outstanding[t])
+		}
+		if len(lost) > 0 {
+			utils.Log("amqp: session to %s lost with %d messages unconfirmed, republishing", p.Exchange, len(lost))
+		}
+		retry = append(lost, retry...)
+
+		// A new connection starts unblocked
+		blocked.With(blockedLabels).Set(0)
+		pub.Close()
 	}
 	return errors.New("No more sessions left to try")
 }
@@ -261,96 +588,143 @@ func (c *AMQPConsumer) SetAckThreshold(threshold int) {
 	c.AckThreshold = threshold
 }
 
-func (c *AMQPConsumer) declareAndBindQ(sub AMQPSession) error {
-	qArgs := make(amqp.Table)
-	qExchange := c.Exchange
+// Acknowledge on a one second tick or every AckThreshold messages, instead
+// of leaving each delivery to be settled once handled.
+func (c *AMQPConsumer) SetBatchAck(batch bool) {
+	c.BatchAck = batch
+}
 
-	if c.ShardedExchange != "" {
-		exArgs := amqp.Table{
-			"alternate-exchange": c.DLExchange,
+// declarations lists the exchanges and queues the consumer needs, besides
+// the event type exchange declared as it connects.
+func (c *AMQPConsumer) declarations() ([]declaration, error) {
+	var decls []declaration
+	if c.Verify {
+		kind := c.ExchangeType
+		if kind == "" {
+			kind = "fanout"
 		}
+		decls = append(decls, exchangeDeclaration("event type exchange", c.Exchange, kind, false, nil))
+	}
 
-		qExchange = c.ShardedExchange
-		if err := sub.ExchangeDeclare(
-			c.ShardedExchange, // name
-			"x-random",        // type
-			true,              // durable
-			false,             // auto-deleted
-			true,              // internal
-			true,              // no-wait
-			exArgs,            // arguments
-		); err != nil {
-			return fmt.Errorf("Cannot declare the analytic exchange %q: %v", c.ShardedExchange, err)
-		}
+	if c.ShardedExchange == "" {
+		// The queue is shared by every replica
+		return append(decls, queueDeclaration("queue", c.QueueName, c.Persistent, nil)), nil
+	}
 
-		if err := sub.ExchangeDeclare(
-			c.DLExchange, // name
-			"direct",     // type
-			true,         // durable
-			false,        // auto-deleted
-			false,        // internal
-			true,         // no-wait
-			nil,          // arguments
-		); err != nil {
-			return fmt.Errorf("Cannot declare the analytic dlexchange %q: %v", c.DLExchange, err)
-		}
+	if err := c.Queue.validate(c.Persistent); err != nil {
+		return nil, fmt.Errorf("Cannot declare replica queue %q: %v", c.QueueName, err)
+	}
 
-		if err := sub.ExchangeBind(
-			c.ShardedExchange, // destination
-			"",                // key
-			c.Exchange,        // Source
-			true,              // no-wait
-			nil,               // args
-		); err != nil {
-			return fmt.Errorf("Cannot bind analytic exchange %q to event type %e: %v", c.ShardedExchange, c.Exchange, err)
-		}
+	exArgs := amqp.Table{
+		"alternate-exchange": c.DLExchange,
+	}
+	qArgs := c.Queue.args(c.DLExchange)
+	if c.routed() {
+		// Dead-letter with the key the DLQ is bound with, rather than the
+		// message's own
+		qArgs["x-dead-letter-routing-key"] = ""
+	}
 
-		qArgs["x-dead-letter-exchange"] = c.DLExchange
-		qArgs["x-expires"] = int32(30000)
-		qArgs["x-message-ttl"] = int32(10000)
+	replica := queueDeclaration("replica queue", c.QueueName, c.Persistent, qArgs)
+	replica.instance = true
+
+	return append(decls,
+		exchangeDeclaration("analytic exchange", c.ShardedExchange, c.Queue.ExchangeType, true, exArgs),
+		exchangeDeclaration("analytic dlexchange", c.DLExchange, "direct", false, nil),
+		replica,
+		queueDeclaration("dead letter queue", c.DLQName, true, nil),
+		queueDeclaration("parking lot queue", c.ParkingLot, true, nil),
+	), nil
+}
+
+func (c *AMQPConsumer) declareAndBindQ(sub AMQPSession) error {
+	decls, err := c.declarations()
+	if err != nil {
+		return err
 	}
 
-	if _, err := sub.QueueDeclare(
-		c.QueueName,   // name
-		c.Persistent,  // durable
-		!c.Persistent, // delete when unused
-		!c.Persistent, // exclusive
-		true,          // no-wait
-		qArgs,         // arguments
-	); err != nil {
-		return fmt.Errorf("Cannot declare replica queue %q: %v", c.QueueName, err)
+	// Verifying, only what belongs to this instance is declared and bound
+	if c.Verify {
+		var shared []declaration
+		for _, d := range decls {
+			if !d.instance {
+				shared = append(shared, d)
+			}
+		}
+		if err := verify(sub.Connection, shared); err != nil {
+			return err
+		}
+	}
+	for _, d := range decls {
+		if c.Verify && !d.instance {
+			continue
+		}
+		if err := d.declare(sub.Channel, false); err != nil {
+			return fmt.Errorf("Cannot declare the %s %q: %v", d.what, d.name, err)
+		}
 	}
 
-	if err := sub.QueueBind(
-		c.QueueName, // queue name
-		"",          // routing key
-		qExchange,   // exchange
-		true,        // no-wait
-		nil,         // args
-	); err != nil {
-		return fmt.Errorf("Cannot consume without a binding to exchange: %q, %v", qExchange, err)
+	qExchange := c.Exchange
+	queueBindings := c.bindings()
+	if c.Verify {
+		// The queue is shared, so its bindings are left alone
+		queueBindings = nil
 	}
 
-	if c.DLExchange != "" {
-		if _, err := sub.QueueDeclare(
-			c.DLQName, // name
-			true,      // durable
-			false,     // delete when unused
-			false,     // exclusive
-			true,      // no-wait
-			nil,       // arguments
-		); err != nil {
-			return fmt.Errorf("Cannot declare dead letter queue %q: %v", c.DLQName, err)
+	if c.ShardedExchange != "" {
+		qExchange = c.ShardedExchange
+		queueBindings = []Binding{{Key: c.Queue.shardKey()}}
+	}
+
+	// Bindings are shared by every replica, and left in place when one goes
+	// away; verifying, they are left alone
+	if c.ShardedExchange != "" && !c.Verify {
+		for _, b := range c.bindings() {
+			if err := sub.ExchangeBind(
+				c.ShardedExchange, // destination
+				b.Key,             // key
+				c.Exchange,        // Source
+				false,             // no-wait
+				b.Headers,         // args
+			); err != nil {
+				return fmt.Errorf("Cannot bind analytic exchange %q to event type %q: %v", c.ShardedExchange, c.Exchange, err)
+			}
 		}
+	}
 
+	for _, b := range queueBindings {
 		if err := sub.QueueBind(
-			c.DLQName,    // queue name
-			"",           // routing key
-			c.DLExchange, // exchange
-			true,         // no-wait
-			nil,          // args
+			c.QueueName, // queue name
+			b.Key,       // routing key
+			qExchange,   // exchange
+			false,       // no-wait
+			b.Headers,   // args
 		); err != nil {
-			return fmt.Errorf("Cannot consume without a binding to exchange: %q, %v", c.DLExchange, err)
+			return fmt.Errorf("Cannot consume without a binding to exchange: %q, %v", qExchange, err)
+		}
+	}
+
+	if c.DLExchange != "" && !c.Verify {
+		// Messages the sharded exchange cannot route reach the DLX through
+		// its alternate exchange with their own routing key, so the DLQ is
+		// bound with each literal key as well. Those matched by a wildcard
+		// are dropped while no replica is running.
+		keys := []string{""}
+		for _, b := range c.bindings() {
+			if b.Key != "" && !strings.ContainsAny(b.Key, "*#") {
+				keys = append(keys, b.Key)
+			}
+		}
+		for _, key := range keys {
+			if err := sub.QueueBind(
+				c.DLQName,    // queue name
+				key,          // routing key
+				c.DLExchange, // exchange
+				false,        // no-wait
+				nil,          // args
+			); err != nil {
+				return fmt.Errorf("Cannot consume without a binding to exchange: %q, %v", c.DLExchange, err)
+			}
 		}
 	}
 
@@ -358,29 +732,60 @@ func (c *AMQPConsumer) declareAndBindQ(sub AMQPSession) error {
 	return nil
 }
 
-func (c *AMQPConsumer) Consume(handle func([]byte, time.Time)) error {
+// Consume passes deliveries from the queue, and the DLQ for a sharded
+// consumer, to handle until ctx is done. The subscriptions are then
+// cancelled, but their channels stay open until the consumer's own context
+// is done, so that deliveries already handed out can still be settled.
+func (c *AMQPConsumer) Consume(ctx context.Context, handle func(broker.Delivery)) error {
+
+	// Each consumeQ sends the error it stopped on, if any, as it exits
+	exitQ := make(chan error, 1)
+	exitDLQ := make(chan error, 1)
 
-	exitQ := make(chan struct{})
-	exitDLQ := make(chan struct{})
+	// Done once each consumeQ will call handle no more
+	var handling sync.WaitGroup
 
-	go consumeQ(c, c.QueueName, c.Exchange, true, handle, exitQ)
+	handling.Add(1)
+	// Streams cannot be consumed exclusively
+	exclusive := c.Queue.Type != "stream"
+	go consumeQ(ctx, c, c.QueueName, c.Exchange, exclusive, handle, &handling, exitQ)
 	if c.DLExchange != "" {
-		go consumeQ(c, c.DLQName, c.DLExchange, false, handle, exitDLQ)
+		handling.Add(1)
+		go consumeQ(ctx, c, c.DLQName, c.DLExchange, false, handle, &handling, exitDLQ)
 	}
 
 	select {
-	case <-exitQ:
+	case <-ctx.Done():
+		handling.Wait()
+		return nil
+	case err := <-exitQ:
+		if err != nil {
+			return err
+		}
 		return fmt.Errorf("Consuming form the Queue unexepctedly exited")
-	case <-exitDLQ:
+	case err := <-exitDLQ:
+		if err != nil {
+			return err
+		}
 		return fmt.Errorf("Consuming form the DLQ unexepctedly exited")
 	}
 }
 
 // subscribe consumes deliveries from an exclusive queue from a fanout exchange and sends to the application specific messages chan.
-func consumeQ(c *AMQPConsumer, queue string, exchange string, exclusive bool, handle func([]byte, time.Time), exit chan struct{}) {
+func consumeQ(ctx context.Context, c *AMQPConsumer, queue string, exchange string, exclusive bool, handle func(broker.Delivery), handling *sync.WaitGroup, exit chan error) {
+	var once sync.Once
+	stopped := func() { once.Do(handling.Done) }
+	defer stopped()
+
 	declared := false
+	// Failing to declare the queues, or to consume from them, is terminal
+	var failed error
 	for session := range c.sessions {
 
+		if ctx.Err() != nil {
+			break // we have been asked to stop consuming
+		}
+
 		utils.Log("amqp: Attempting to join a session to consume")
 		sub, ok := <-session
 		if !ok {
@@ -397,10 +802,14 @@ func consumeQ(c *AMQPConsumer, queue string, exchange string, exclusive bool, ha
 		// Launch ack goroutine
 		go acker(sub, ackQueue, x)
 		notify := sub.Channel.NotifyClose(make(chan *amqp.Error))
+		cancelled := sub.Channel.NotifyCancel(make(chan string, 1))
 
 		if !declared {
 			if err := c.declareAndBindQ(sub); err != nil {
-				utils.Log("Failed to bind queues: %v", queue, err)
+				utils.Log("Failed to bind queues: %q, %v", queue, err)
+				failed = err
+				close(x)
+				sub.Close()
 				break
 			}
 			declared = true
@@ -415,58 +824,95 @@ func consumeQ(c *AMQPConsumer, queue string, exchange string, exclusive bool, ha
 			break
 		}
 
+		tag := fmt.Sprintf("%s-%s", queue, uuid.New())
 		deliveries, err := sub.Consume(
 			queue,     // queue
-			"",        // consumer
+			tag,       // consumer
 			false,     // auto-ack
 			exclusive, // exclusive
 			false,     // no-local
-			true,      // no-wait
+			false,     // no-wait
 			nil,       // args
 		)
 		if err != nil {
 			utils.Log("Cannot consume from: %q, %v", queue, err)
+			failed = fmt.Errorf("Cannot consume from %q: %v", queue, err)
+			close(x)
+			sub.Close()
 			break
 		}
 
 		utils.Log("amqp: subscribed to events from: %s", exchange)
 		count := 0
+		var lastTag uint64
 
 	Sub:
 		for { //receive loop
 			select { //check connection
-			case <-c.ctx.Done():
-				if c.ShardedExchange != "" {
+			case <-ctx.Done():
+				// Stop deliveries, but hold the channel open for settling
+				// those already handled until the connection is closed
+				if err := sub.Cancel(tag, false); err != nil {
+					utils.Log("Failure cancelling consumer on: %q, %v", queue, err)
+				}
+				if c.ShardedExchange != "" && queue == c.QueueName {
 					//we need to unbind the queue
 					if err := sub.QueueUnbind(
-						queue,             // queue name
-						"",                // routing key
-						c.ShardedExchange, // exchange
+						queue,              // queue name
+						c.Queue.shardKey(), // routing key
+						c.ShardedExchange,  // exchange
 						nil,
 					); err != nil {
-						utils.Log("Failure unbinding the queue from exchange: %q, %e - %v", queue, c.ShardedExchange, err)
-						break Sub
+						utils.Log("Failure unbinding the queue from exchange: %q, %s - %v", queue, c.ShardedExchange, err)
 					}
 				}
+				stopped()
+
+				if c.BatchAck && lastTag != 0 {
+					// everything delivered has been handed to the handler
+					sub.Ack(lastTag, true)
+				}
+				select {
+				case <-c.ctx.Done():
+				case <-notify:
+				}
 				break Sub
 			case err = <-notify:
 				break Sub //reconnect
 
+			case <-cancelled:
+				// The broker cancels consumers of a queue which has been
+				// deleted, so declare it again before resubscribing
+				utils.Log("amqp: consumer on %s was cancelled by the broker, redeclaring and resubscribing", queue)
+				declared = false
+				break Sub
+
 			case msg, ok := <-deliveries:
 				if !ok {
 					utils.Log("amqp: consumer on %s has ended, attempting to reconnect", queue)
 					deliveries = nil
+					declared = false
 					break Sub
 				}
 
-				nsTime := time.Time{}
-				if s, ok := msg.Headers["timestamp_in_ns"].(string); ok {
-					secs, _ := strconv.Atoi(s[0 : len(s)-9])
-					nSecs, _ := strconv.Atoi(s[len(s)-9:])
-					nsTime = time.Unix(int64(secs), int64(nSecs))
+				// Handle the message (normally place on channel and metricate)
+				d := &delivery{msg: msg, ts: publishTime(msg), env: envelope(msg), manual: !c.BatchAck}
+				if c.poisoned(msg) {
+					c.park(sub, d, queue)
+				} else if n, ok := msg.Headers[batchHeader].(int32); ok {
+					if err := unbatch(d, int(n), handle); err != nil {
+						utils.Log("amqp: rejecting malformed batch from %s: %v", queue, err)
+						d.Reject()
+					}
+				} else {
+					handle(d)
 				}
-				handle(msg.Body, nsTime) // Handle the message (normally place on channel and metricate)
 				count += 1
+				lastTag = msg.DeliveryTag
+
+				if !c.BatchAck {
+					break
+				}
 
 				select {
 				case <-tickChan:
@@ -486,5 +932,5 @@ func consumeQ(c *AMQPConsumer, queue string, exchange string, exclusive bool, ha
 	}
 
 	utils.Log("amqp: No more sessions left to try for q: %s", queue)
-	close(exit)
+	exit <- failed
 }
@@ -0,0 +1,463 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+// fakeBroker stands in for RabbitMQ, handing out connections whose channels
+// record what clients do with them
+type fakeBroker struct {
+	mu sync.Mutex
+	// Exchanges and queues which exist, for passive declarations
+	exists map[string]bool
+	// Calls which change the topology, such as "QueueBind q key exchange"
+	calls []string
+	// Connections dialled, and the number of dials to fail first
+	conns    []*fakeConn
+	failures int
+
+	// Every message published, as it is published
+	published chan fakePublishing
+	// Whether each publishing is acked or nacked, or is never confirmed;
+	// everything is acked if unset
+	confirm func(p fakePublishing) (ack bool, confirmed bool)
+	// Deliveries for consumers, by queue
+	queues map[string]chan amqp.Delivery
+}
+
+type fakePublishing struct {
+	// Connection published on, counting from 1
+	conn     int
+	tag      uint64
+	exchange string
+	key      string
+	msg      amqp.Publishing
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		exists:    make(map[string]bool),
+		published: make(chan fakePublishing, 1000),
+		queues:    make(map[string]chan amqp.Delivery),
+	}
+}
+
+func (b *fakeBroker) dial() (Connection, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures > 0 {
+		b.failures--
+		return nil, errors.New("connection refused")
+	}
+	conn := &fakeConn{broker: b, n: len(b.conns) + 1}
+	b.conns = append(b.conns, conn)
+	return conn, nil
+}
+
+// conn returns the n'th connection dialled, counting from 1
+func (b *fakeBroker) conn(n int) *fakeConn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conns[n-1]
+}
+
+func (b *fakeBroker) record(call string, args ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, strings.Join(append([]string{call}, args...), " "))
+}
+
+// recorded returns the calls made starting with prefix
+func (b *fakeBroker) recorded(prefix string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var calls []string
+	for _, call := range b.calls {
+		if strings.HasPrefix(call, prefix) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// next returns the next message published
+func (b *fakeBroker) next(t *testing.T) fakePublishing {
+	select {
+	case p := <-b.published:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message to be published")
+		return fakePublishing{}
+	}
+}
+
+// client makes a client connect to the fake broker, retrying quickly
+func (b *fakeBroker) client(c *AMQPClient) {
+	c.dialer = b.dial
+	c.Backoff = Backoff{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1}
+}
+
+type fakeConn struct {
+	broker *fakeBroker
+	n      int
+
+	mu       sync.Mutex
+	closed   bool
+	channels []*fakeChannel
+	blocking []chan amqp.Blocking
+}
+
+func (c *fakeConn) Channel() (Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &fakeChannel{conn: c}
+	c.channels = append(c.channels, ch)
+	return ch, nil
+}
+
+func (c *fakeConn) NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blocking = append(c.blocking, receiver)
+	return receiver
+}
+
+// block tells clients the broker has started or stopped blocking publishers,
+// returning once they have been told
+func (c *fakeConn) block(active bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, receiver := range c.blocking {
+		receiver <- amqp.Blocking{Active: active, Reason: "low on memory"}
+		for len(receiver) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// Close closes the connection and its channels, as happens when the broker
+// goes away
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	channels := c.channels
+	c.mu.Unlock()
+
+	for _, ch := range channels {
+		ch.Close()
+	}
+	return nil
+}
+
+type fakeChannel struct {
+	conn *fakeConn
+
+	mu         sync.Mutex
+	closed     bool
+	confirming bool
+	tag        uint64
+	confirms   []chan amqp.Confirmation
+	closes     []chan *amqp.Error
+	cancels    []chan string
+}
+
+func (ch *fakeChannel) declare(what string, name string, passive bool) error {
+	b := ch.conn.broker
+	if passive {
+		b.mu.Lock()
+		exists := b.exists[name]
+		b.mu.Unlock()
+		if !exists {
+			ch.Close()
+			return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no %s '%s'", what, name)}
+		}
+		return nil
+	}
+	// Declaring what exists with the same settings changes nothing
+	b.mu.Lock()
+	exists := b.exists[name]
+	b.exists[name] = true
+	b.mu.Unlock()
+	if !exists {
+		b.record(what+"Declare", name)
+	}
+	return nil
+}
+
+func (ch *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return ch.declare("Exchange", name, false)
+}
+
+func (ch *fakeChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return ch.declare("Exchange", name, true)
+}
+
+func (ch *fakeChannel) ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error {
+	ch.conn.broker.record("ExchangeBind", destination, key, source)
+	return nil
+}
+
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, ch.declare("Queue", name, false)
+}
+
+func (ch *fakeChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, ch.declare("Queue", name, true)
+}
+
+func (ch *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	ch.conn.broker.record("QueueBind", name, key, exchange)
+	return nil
+}
+
+func (ch *fakeChannel) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	ch.conn.broker.record("QueueUnbind", name, key, exchange)
+	return nil
+}
+
+func (ch *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.queues[queue] == nil {
+		b.queues[queue] = make(chan amqp.Delivery, 100)
+	}
+	return b.queues[queue], nil
+}
+
+func (ch *fakeChannel) Cancel(consumer string, noWait bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) Ack(tag uint64, multiple bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.confirming = true
+	return nil
+}
+
+func (ch *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	p := fakePublishing{conn: ch.conn.n, exchange: exchange, key: key, msg: msg}
+	if ch.confirming {
+		ch.tag++
+		p.tag = ch.tag
+	}
+	b := ch.conn.broker
+	b.published <- p
+
+	if !ch.confirming {
+		return nil
+	}
+	ack, confirmed := true, true
+	if b.confirm != nil {
+		ack, confirmed = b.confirm(p)
+	}
+	if confirmed {
+		for _, c := range ch.confirms {
+			c <- amqp.Confirmation{DeliveryTag: p.tag, Ack: ack}
+		}
+	}
+	return nil
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+func (ch *fakeChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.closes = append(ch.closes, c)
+	return c
+}
+
+func (ch *fakeChannel) NotifyCancel(c chan string) chan string {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.cancels = append(ch.cancels, c)
+	return c
+}
+
+// Close closes the channel's notifications, as the library does
+func (ch *fakeChannel) Close() error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.closed {
+		return nil
+	}
+	ch.closed = true
+	for _, c := range ch.confirms {
+		close(c)
+	}
+	for _, c := range ch.closes {
+		close(c)
+	}
+	for _, c := range ch.cancels {
+		close(c)
+	}
+	return nil
+}
+
+// publish publishes the messages through p, returning what Publish does
+func publish(t *testing.T, p *AMQPPublisher, bodies ...string) chan error {
+	messages := make(chan broker.Message, len(bodies))
+	for _, body := range bodies {
+		messages <- broker.Message{Body: []byte(body)}
+	}
+	close(messages)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Publish(messages)
+	}()
+	return done
+}
+
+func wait(t *testing.T, done chan error) {
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Publish returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Publish to return")
+	}
+}
+
+// expect checks the next messages published, "body@conn#tag"
+func expect(t *testing.T, b *fakeBroker, expected ...string) {
+	t.Helper()
+	var got []string
+	for range expected {
+		p := b.next(t)
+		got = append(got, fmt.Sprintf("%s@%d#%d", p.msg.Body, p.conn, p.tag))
+	}
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("got %v published, expected %v", got, expected)
+	}
+}
+
+func TestPublishConfirms(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := newFakeBroker()
+	p := NewPublisher(ctx, "processed", "amqp://fake/")
+	b.client(&p.AMQPClient)
+	p.SetMaxInFlight(2)
+
+	// Publish returns once every message has been confirmed
+	wait(t, publish(t, p, "a", "b", "c"))
+	expect(t, b, "a@1#1", "b@1#2", "c@1#3")
+}
+
+func TestPublishNacked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := newFakeBroker()
+	nacked := false
+	b.confirm = func(p fakePublishing) (bool, bool) {
+		if string(p.msg.Body) == "b" && !nacked {
+			nacked = true
+			return false, true
+		}
+		return true, true
+	}
+	p := NewPublisher(ctx, "processed", "amqp://fake/")
+	b.client(&p.AMQPClient)
+
+	// Messages the broker nacks are published again
+	wait(t, publish(t, p, "a", "b", "c"))
+	expect(t, b, "a@1#1", "b@1#2", "b@1#3", "c@1#4")
+}
+
+func TestPublishBlocked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := newFakeBroker()
+	p := NewPublisher(ctx, "processed", "amqp://fake/")
+	b.client(&p.AMQPClient)
+
+	messages := make(chan broker.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Publish(messages)
+	}()
+	messages <- broker.Message{Body: []byte("a")}
+	expect(t, b, "a@1#1")
+
+	// While the broker blocks publishing nothing is published, and beyond
+	// the message being batched nothing more is taken, so senders wait
+	// rather than messages piling up
+	b.conn(1).block(true)
+	messages <- broker.Message{Body: []byte("b")}
+	select {
+	case messages <- broker.Message{Body: []byte("c")}:
+		t.Fatal("message taken while the broker blocks publishing")
+	case p := <-b.published:
+		t.Fatalf("%s published while the broker blocks publishing", p.msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.conn(1).block(false)
+	messages <- broker.Message{Body: []byte("c")}
+	close(messages)
+	wait(t, done)
+	expect(t, b, "b@1#2", "c@1#3")
+}
+
+func TestPublishLostConfirms(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The first connection confirms nothing
+	b := newFakeBroker()
+	b.confirm = func(p fakePublishing) (bool, bool) {
+		return true, p.conn != 1
+	}
+	p := NewPublisher(ctx, "processed", "amqp://fake/")
+	b.client(&p.AMQPClient)
+	p.SetMaxInFlight(2)
+
+	done := publish(t, p, "a", "b", "c")
+	expect(t, b, "a@1#1", "b@1#2")
+
+	// Losing the connection, the unconfirmed messages go out again, in
+	// order, before the rest. Delivery tags start again on the new channel,
+	// and confirms for them settle the republished messages.
+	b.conn(1).Close()
+	wait(t, done)
+	expect(t, b, "a@2#1", "b@2#2", "c@2#3")
+}
@@ -0,0 +1,50 @@
+package amqp
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff controls how long redial waits between attempts to reach a broker
+// which cannot be connected to.
+type Backoff struct {
+	// Delay before the first retry
+	Initial time.Duration
+	// Longest delay between retries, unlimited if zero
+	Max time.Duration
+	// Growth of the delay after each failed attempt, DefaultBackoff's if
+	// below one
+	Multiplier float64
+	// Fraction of each delay which is randomised, so that workers
+	// reconnecting after a broker restart don't all retry together
+	Jitter float64
+	// Time to keep retrying before giving up, forever if zero
+	MaxElapsed time.Duration
+}
+
+var DefaultBackoff = Backoff{
+	Initial:    500 * time.Millisecond,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+	MaxElapsed: 5 * time.Minute,
+}
+
+// Delay before retry number attempt, counting from zero
+func (b Backoff) Delay(attempt int) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = DefaultBackoff.Multiplier
+	}
+	d := float64(b.Initial)
+	for i := 0; i < attempt && (b.Max <= 0 || d < float64(b.Max)); i++ {
+		d *= multiplier
+	}
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,135 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		b        Backoff
+		expected []time.Duration
+	}{
+		{
+			"capped",
+			Backoff{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2},
+			[]time.Duration{
+				1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+				10 * time.Second, 10 * time.Second,
+			},
+		},
+		{
+			// No cap keeps growing
+			"max 0",
+			Backoff{Initial: time.Second, Multiplier: 2},
+			[]time.Duration{
+				1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+				16 * time.Second, 32 * time.Second,
+			},
+		},
+		{
+			// No multiplier grows by the default rather than dropping to 0
+			"multiplier 0",
+			Backoff{Initial: time.Second, Max: 10 * time.Second},
+			[]time.Duration{
+				1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+				10 * time.Second, 10 * time.Second,
+			},
+		},
+	} {
+		for attempt, expected := range test.expected {
+			if d := test.b.Delay(attempt); d != expected {
+				t.Errorf("%s: attempt %d: delay %s, expected %s", test.name, attempt, d, expected)
+			}
+		}
+	}
+
+	b := Backoff{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2}
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := b.Delay(2); d < 2*time.Second || d > 6*time.Second {
+			t.Fatalf("delay %s with jitter is outside 2s-6s", d)
+		}
+	}
+}
+
+func TestBackoffMaxElapsed(t *testing.T) {
+	if DefaultBackoff.MaxElapsed != 5*time.Minute {
+		t.Errorf("default MaxElapsed is %s, expected 5m", DefaultBackoff.MaxElapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Redialling gives up once the broker has been unreachable too long
+	b := newFakeBroker()
+	b.failures = 1 << 30
+	c := &AMQPClient{Exchange: "processed"}
+	b.client(c)
+	c.Backoff.MaxElapsed = 20 * time.Millisecond
+
+	session := <-redial(ctx, c, "publisher")
+	select {
+	case _, ok := <-session:
+		if ok {
+			t.Error("got a session from an unreachable broker")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still redialling after MaxElapsed")
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The broker is unreachable for most of MaxElapsed, both before the
+	// first connection and after it is lost
+	b := newFakeBroker()
+	var mu sync.Mutex
+	var until time.Time
+	unreachable := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		until = time.Now().Add(d)
+	}
+	c := &AMQPClient{Exchange: "processed"}
+	b.client(c)
+	c.Backoff.MaxElapsed = 200 * time.Millisecond
+	c.dialer = func() (Connection, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Now().Before(until) {
+			return nil, errors.New("connection refused")
+		}
+		return b.dial()
+	}
+
+	connect := func(sessions chan chan AMQPSession) AMQPSession {
+		select {
+		case sess, ok := <-<-sessions:
+			if !ok {
+				t.Fatal("gave up connecting")
+			}
+			return sess
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out connecting")
+			return AMQPSession{}
+		}
+	}
+
+	unreachable(50 * time.Millisecond)
+	sessions := redial(ctx, c, "publisher")
+	sess := connect(sessions)
+
+	// The time spent failing counts again from zero once connected, so
+	// redialling long after the first failure still succeeds
+	time.Sleep(300 * time.Millisecond)
+	sess.Close()
+	unreachable(50 * time.Millisecond)
+	connect(sessions).Close()
+}
@@ -0,0 +1,239 @@
+package amqp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+// Header carrying the number of messages packed into a batch
+const batchHeader = "batch_size"
+
+// publishing is what the publisher sends as one AMQP message: a single
+// message, or count messages packed into a batch, with their routing key
+// and envelope. parts are the envelopes of a batch's messages. headers are
+// those a headers exchange routes it on, once read from the body.
+type publishing struct {
+	body    []byte
+	count   int
+	key     string
+	env     broker.Envelope
+	parts   []broker.Envelope
+	headers amqp.Table
+}
+
+// A batch body is each message preceded by its length as a uvarint.
+func encodeBatch(msgs [][]byte) []byte {
+	size := 0
+	for _, msg := range msgs {
+		size += binary.MaxVarintLen64 + len(msg)
+	}
+
+	body := make([]byte, 0, size)
+	var n [binary.MaxVarintLen64]byte
+	for _, msg := range msgs {
+		body = append(body, n[:binary.PutUvarint(n[:], uint64(len(msg)))]...)
+		body = append(body, msg...)
+	}
+	return body
+}
+
+func decodeBatch(body []byte, count int) ([][]byte, error) {
+	msgs := make([][]byte, 0, count)
+	for len(body) > 0 {
+		size, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < size {
+			return nil, errors.New("truncated batch")
+		}
+		body = body[n:]
+		msgs = append(msgs, body[:size:size])
+		body = body[size:]
+	}
+	if len(msgs) != count {
+		return nil, fmt.Errorf("batch has %d messages, header says %d", len(msgs), count)
+	}
+	return msgs, nil
+}
+
+// batch reads messages into publishings. With a size above one, the messages
+// already waiting, and those arriving within linger, are packed together as
+// long as they are batchable; any other message starts the next batch. The
+// publishings channel is closed once messages is closed and drained.
+func batch(messages <-chan broker.Message, size int, linger time.Duration) <-chan publishing {
+	out := make(chan publishing)
+
+	go func() {
+		defer close(out)
+
+		var (
+			msg  broker.Message
+			open bool
+			// msg has been read, but belongs to the next batch
+			held bool
+		)
+		for {
+			if !held {
+				msg, open = <-messages
+				if !open {
+					return
+				}
+			}
+			held = false
+			if size <= 1 {
+				out <- publishing{body: msg.Body, key: msg.Key, env: msg.Envelope}
+				continue
+			}
+
+			first := msg
+			msgs := [][]byte{msg.Body}
+			parts := []broker.Envelope{msg.Envelope}
+			var timeout <-chan time.Time
+			if linger > 0 {
+				timeout = time.After(linger)
+			}
+
+		Fill:
+			for len(msgs) < size {
+				if timeout == nil {
+					// Take only what is already waiting
+					select {
+					case msg, open = <-messages:
+					default:
+						break Fill
+					}
+				} else {
+					select {
+					case msg, open = <-messages:
+					case <-timeout:
+						break Fill
+					}
+				}
+				if !open {
+					break
+				}
+				if !batchable(first, msg) {
+					held = true
+					break
+				}
+				msgs = append(msgs, msg.Body)
+				parts = append(parts, msg.Envelope)
+			}
+
+			out <- publishing{
+				body:  encodeBatch(msgs),
+				count: len(msgs),
+				key:   first.Key,
+				env:   first.Envelope,
+				parts: parts,
+			}
+			if !open {
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// batchDelivery settles the AMQP message a batch arrived in once every
+// message unpacked from it has been settled: nacking it if any were nacked,
+// otherwise rejecting it if any were rejected, and otherwise acking it. The
+// whole batch is redelivered or dead-lettered, including messages which were
+// acked.
+type batchDelivery struct {
+	d *delivery
+
+	mu        sync.Mutex
+	remaining int
+	nacked    bool
+	rejected  bool
+}
+
+func (b *batchDelivery) settle(nack bool, reject bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nacked = b.nacked || nack
+	b.rejected = b.rejected || reject
+	b.remaining--
+	if b.remaining > 0 {
+		return nil
+	}
+
+	switch {
+	case b.nacked:
+		return b.d.Nack()
+	case b.rejected:
+		return b.d.Reject()
+	default:
+		return b.d.Ack()
+	}
+}
+
+// batchPart is one message unpacked from a batch
+type batchPart struct {
+	batch *batchDelivery
+	body  []byte
+	env   broker.Envelope
+	once  sync.Once
+}
+
+func (p *batchPart) Body() []byte {
+	return p.body
+}
+
+func (p *batchPart) Timestamp() time.Time {
+	return p.batch.d.ts
+}
+
+func (p *batchPart) Envelope() broker.Envelope {
+	return p.env
+}
+
+func (p *batchPart) Key() string {
+	return p.batch.d.msg.RoutingKey
+}
+
+func (p *batchPart) settle(nack bool, reject bool) error {
+	var err error
+	p.once.Do(func() {
+		err = p.batch.settle(nack, reject)
+	})
+	return err
+}
+
+func (p *batchPart) Ack() error {
+	return p.settle(false, false)
+}
+
+func (p *batchPart) Nack() error {
+	return p.settle(true, false)
+}
+
+func (p *batchPart) Reject() error {
+	return p.settle(false, true)
+}
+
+// unbatch hands each message packed into the delivery to handle.
+func unbatch(d *delivery, count int, handle func(broker.Delivery)) error {
+	msgs, err := decodeBatch(d.msg.Body, count)
+	if err != nil {
+		return err
+	}
+
+	b := &batchDelivery{d: d, remaining: len(msgs)}
+	if len(msgs) == 0 {
+		return d.Ack()
+	}
+	envs := partEnvelopes(d, len(msgs))
+	for i, msg := range msgs {
+		handle(&batchPart{batch: b, body: msg, env: envs[i]})
+	}
+	return nil
+}
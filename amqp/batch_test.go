@@ -0,0 +1,142 @@
+package amqp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+// acknowledger records how a delivery was settled
+type acknowledger struct {
+	settled []string
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	a.settled = append(a.settled, "ack")
+	return nil
+}
+
+func (a *acknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.settled = append(a.settled, "nack")
+	return nil
+}
+
+func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	a.settled = append(a.settled, "reject")
+	return nil
+}
+
+func TestBatchEncoding(t *testing.T) {
+	msgs := [][]byte{[]byte("one"), {}, make([]byte, 300)}
+
+	decoded, err := decodeBatch(encodeBatch(msgs), len(msgs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(msgs) {
+		t.Fatalf("decoded %d messages, expected %d", len(decoded), len(msgs))
+	}
+	for i := range msgs {
+		if string(decoded[i]) != string(msgs[i]) {
+			t.Errorf("message %d: got %q, expected %q", i, decoded[i], msgs[i])
+		}
+	}
+
+	if _, err := decodeBatch(encodeBatch(msgs)[:10], len(msgs)); err == nil {
+		t.Error("truncated batch decoded without error")
+	}
+	if _, err := decodeBatch(encodeBatch(msgs), 2); err == nil {
+		t.Error("batch with the wrong count decoded without error")
+	}
+}
+
+func TestBatchPacking(t *testing.T) {
+	messages := make(chan broker.Message, 10)
+	for i := 0; i < 7; i++ {
+		messages <- broker.Message{Body: []byte(fmt.Sprintf("msg-%d", i))}
+	}
+	close(messages)
+
+	var counts []int
+	total := 0
+	for out := range batch(messages, 3, time.Second) {
+		msgs, err := decodeBatch(out.body, out.count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range msgs {
+			if expected := fmt.Sprintf("msg-%d", total); string(msg) != expected {
+				t.Errorf("got %q, expected %q", msg, expected)
+			}
+			total++
+		}
+		counts = append(counts, out.count)
+	}
+
+	if fmt.Sprint(counts) != "[3 3 1]" {
+		t.Errorf("got batches of %v, expected [3 3 1]", counts)
+	}
+}
+
+func TestBatchRoutingKeys(t *testing.T) {
+	messages := make(chan broker.Message, 10)
+	for _, key := range []string{"dns", "dns", "http", "dns", "dns", "dns"} {
+		messages <- broker.Message{Body: []byte(key), Key: key}
+	}
+	close(messages)
+
+	var got []string
+	for out := range batch(messages, 4, time.Second) {
+		got = append(got, fmt.Sprintf("%s:%d", out.key, out.count))
+	}
+
+	// Messages with different keys are never packed together
+	if fmt.Sprint(got) != "[dns:2 http:1 dns:3]" {
+		t.Errorf("got batches of %v, expected [dns:2 http:1 dns:3]", got)
+	}
+}
+
+func TestBatchSettlement(t *testing.T) {
+	for _, test := range []struct {
+		settle   []string
+		expected string
+	}{
+		{[]string{"ack", "ack", "ack"}, "[ack]"},
+		{[]string{"ack", "reject", "ack"}, "[reject]"},
+		{[]string{"reject", "nack", "ack"}, "[nack]"},
+		{[]string{"ack", "ack"}, "[]"},
+	} {
+		ack := &acknowledger{}
+		d := &delivery{
+			msg: amqp.Delivery{
+				Acknowledger: ack,
+				Body:         encodeBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}),
+			},
+			manual: true,
+		}
+
+		var parts []broker.Delivery
+		if err := unbatch(d, 3, func(p broker.Delivery) { parts = append(parts, p) }); err != nil {
+			t.Fatal(err)
+		}
+		for i, how := range test.settle {
+			switch how {
+			case "ack":
+				parts[i].Ack()
+				// Settling a message twice must not count twice
+				parts[i].Ack()
+			case "nack":
+				parts[i].Nack()
+			case "reject":
+				parts[i].Reject()
+			}
+		}
+
+		if got := fmt.Sprint(ack.settled); got != test.expected {
+			t.Errorf("%v: batch settled %s, expected %s", test.settle, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package amqp
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/streadway/amqp"
+
+	"github.com/trustnetworks/analytics-common/compression"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Binding selects the messages a consumer receives from its exchange, so
+// that the broker filters out events the analytic has no use for.
+type Binding struct {
+	// Routing key, or pattern using "*" and "#" on a topic exchange
+	Key string
+	// Header values to match on a headers exchange, with "x-match" set to
+	// "all" or "any"
+	Headers amqp.Table
+}
+
+// Bind to a topic, direct or headers exchange with the given bindings in
+// place of one matching everything. Messages match if any binding does.
+func (c *AMQPConsumer) SetBindings(kind string, bindings ...Binding) {
+	c.ExchangeType = kind
+	c.Bindings = bindings
+}
+
+// bindings returns the consumer's bindings, or one which receives every
+// message published to its exchange.
+func (c *AMQPConsumer) bindings() []Binding {
+	if len(c.Bindings) > 0 {
+		return c.Bindings
+	}
+	if c.ExchangeType == "topic" {
+		return []Binding{{Key: "#"}}
+	}
+	return []Binding{{}}
+}
+
+// routed reports whether messages reach the consumer with routing keys of
+// their own, which dead-lettering would otherwise keep.
+func (c *AMQPConsumer) routed() bool {
+	return c.ExchangeType != "" && c.ExchangeType != "fanout"
+}
+
+// parseBindings reads the bindings in the filter part of an input
+// "exchange/filter". On a headers exchange the filter is a comma separated
+// list of header=value pairs, all of which must match unless match is
+// "any"; otherwise it is a comma separated list of routing keys.
+func parseBindings(kind string, filter string, match string) []Binding {
+	if filter == "" {
+		return nil
+	}
+
+	if kind == "headers" {
+		if match == "" {
+			match = "all"
+		}
+		headers := amqp.Table{"x-match": match}
+		for _, pair := range strings.Split(filter, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) == 2 {
+				headers[kv[0]] = kv[1]
+			}
+		}
+		return []Binding{{Headers: headers}}
+	}
+
+	var bindings []Binding
+	for _, key := range strings.Split(filter, ",") {
+		bindings = append(bindings, Binding{Key: key})
+	}
+	return bindings
+}
+
+// eventHeaders returns the fields of a datatypes.Event which headers
+// exchanges route on, leaving out any the message does not have.
+func eventHeaders(body []byte) amqp.Table {
+	var e struct {
+		Action  string `json:"action"`
+		Device  string `json:"device"`
+		Network string `json:"network"`
+	}
+	json.Unmarshal(body, &e)
+
+	headers := amqp.Table{}
+	for name, value := range map[string]string{
+		"action":  e.Action,
+		"device":  e.Device,
+		"network": e.Network,
+	} {
+		if value != "" {
+			headers[name] = value
+		}
+	}
+	return headers
+}
+
+// routingHeaders returns the headers a message is routed on through a
+// headers exchange, read from its body as it was before compression.
+func routingHeaders(body []byte, encoding string) amqp.Table {
+	decoded, err := compression.Decode(encoding, body)
+	if err != nil {
+		utils.Log("amqp: cannot read the routing headers of a %s message: %v", encoding, err)
+		return amqp.Table{}
+	}
+	return eventHeaders(decoded)
+}
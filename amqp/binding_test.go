@@ -0,0 +1,96 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/compression"
+)
+
+func TestParseBindings(t *testing.T) {
+	for _, test := range []struct {
+		kind     string
+		filter   string
+		match    string
+		expected string
+	}{
+		{"topic", "", "", "[]"},
+		{"topic", "dns_message", "", "[{dns_message map[]}]"},
+		{"direct", "dns_message,http_request", "", "[{dns_message map[]} {http_request map[]}]"},
+		{"headers", "action=dns_message,network=lab", "", "[{ map[action:dns_message network:lab x-match:all]}]"},
+		{"headers", "action=dns_message", "any", "[{ map[action:dns_message x-match:any]}]"},
+	} {
+		got := fmt.Sprint(parseBindings(test.kind, test.filter, test.match))
+		if got != test.expected {
+			t.Errorf("%s %q: got %s, expected %s", test.kind, test.filter, got, test.expected)
+		}
+	}
+}
+
+func TestConsumerBindings(t *testing.T) {
+	c := &AMQPConsumer{}
+	if got := fmt.Sprint(c.bindings()); got != "[{ map[]}]" {
+		t.Errorf("fanout: got %s, expected one empty binding", got)
+	}
+
+	c.SetBindings("topic")
+	if got := fmt.Sprint(c.bindings()); got != "[{# map[]}]" {
+		t.Errorf("topic: got %s, expected a binding matching everything", got)
+	}
+
+	c.SetBindings("topic", Binding{Key: "http.*"})
+	if got := fmt.Sprint(c.bindings()); got != "[{http.* map[]}]" {
+		t.Errorf("topic: got %s, expected the given binding", got)
+	}
+}
+
+func TestEventHeaders(t *testing.T) {
+	got := eventHeaders([]byte(`{"action":"dns_message","device":"dev1","time":"now"}`))
+	if fmt.Sprint(got) != "map[action:dns_message device:dev1]" {
+		t.Errorf("got headers %v", got)
+	}
+	if got := eventHeaders([]byte("not json")); len(got) != 0 {
+		t.Errorf("got headers %v for a message which is not an event", got)
+	}
+}
+
+func TestCompressedEventHeaders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := newFakeBroker()
+	p := NewPublisher(ctx, "events", "amqp://fake/")
+	b.client(&p.AMQPClient)
+	p.SetRouting("headers", "")
+
+	event := []byte(`{"action":"dns_message","device":"dev1","network":"lan","body":"` + strings.Repeat("a", 2000) + `"}`)
+	c, err := compression.NewCompressor("gzip", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, encoding, err := c.Compress(event)
+	if err != nil || encoding != "gzip" {
+		t.Fatalf("compressed with %q: %v", encoding, err)
+	}
+
+	messages := make(chan broker.Message, 1)
+	messages <- broker.Message{Body: body, Envelope: broker.Envelope{ContentEncoding: encoding}}
+	close(messages)
+	if err := p.Publish(messages); err != nil {
+		t.Fatal(err)
+	}
+
+	// Routed on the event's fields, while the body stays compressed
+	published := b.next(t).msg
+	for name, expected := range map[string]string{"action": "dns_message", "device": "dev1", "network": "lan"} {
+		if got := published.Headers[name]; got != expected {
+			t.Errorf("got %s header %v, expected %q", name, got, expected)
+		}
+	}
+	if published.ContentEncoding != "gzip" || string(published.Body) != string(body) {
+		t.Errorf("published a %q body of %d bytes, expected the gzip body", published.ContentEncoding, len(published.Body))
+	}
+}
@@ -0,0 +1,207 @@
+package amqp
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	// Headers carrying the envelope fields which have no AMQP property of
+	// their own, named as on every transport.
+	schemaHeader      = broker.SchemaVersionHeader
+	traceparentHeader = broker.TraceParentHeader
+	tracestateHeader  = broker.TraceStateHeader
+
+	// Headers carrying, in nanoseconds since the epoch, when the message
+	// was published and when the event it derives from was first ingested
+	publishTimeHeader = "timestamp_in_ns"
+	ingestTimeHeader  = broker.IngestTimeHeader
+
+	// Header carrying the content type of the messages packed into a batch
+	batchContentTypeHeader = "batch_content_type"
+)
+
+// Envelope fields which differ from message to message. Batches carry them
+// for each of their messages in a header of their own.
+var perMessage = []struct {
+	header string
+	get    func(broker.Envelope) string
+	set    func(*broker.Envelope, string)
+}{
+	{
+		"batch_message_ids",
+		func(e broker.Envelope) string { return e.MessageID },
+		func(e *broker.Envelope, s string) { e.MessageID = s },
+	},
+	{
+		"batch_traceparents",
+		func(e broker.Envelope) string { return e.TraceParent },
+		func(e *broker.Envelope, s string) { e.TraceParent = s },
+	},
+	{
+		"batch_tracestates",
+		func(e broker.Envelope) string { return e.TraceState },
+		func(e *broker.Envelope, s string) { e.TraceState = s },
+	},
+	{
+		"batch_ingest_timestamps_in_ns",
+		func(e broker.Envelope) string { return formatNanos(e.IngestTime) },
+		func(e *broker.Envelope, s string) { e.IngestTime, _ = parseNanos(s) },
+	},
+}
+
+// common returns the envelope without its per-message fields.
+func common(env broker.Envelope) broker.Envelope {
+	for _, f := range perMessage {
+		f.set(&env, "")
+	}
+	return env
+}
+
+// formatNanos gives a time in nanoseconds since the epoch, or "" for the
+// zero time.
+func formatNanos(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// parseNanos reads a time given in nanoseconds since the epoch. "" is the
+// zero time.
+func parseNanos(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	ns, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ns), nil
+}
+
+// publishTime returns when a message was published, from its
+// timestamp_in_ns header or, failing that, its AMQP timestamp, which has
+// only second resolution. It is zero if the publisher gave neither.
+func publishTime(msg amqp.Delivery) time.Time {
+	if s, ok := msg.Headers[publishTimeHeader].(string); ok {
+		t, err := parseNanos(s)
+		if err == nil && !t.IsZero() {
+			return t
+		}
+		utils.Log("amqp: ignoring malformed %s header %q", publishTimeHeader, s)
+	}
+	return msg.Timestamp
+}
+
+// Content type of messages published without one
+const defaultContentType = "text/plain"
+
+// message returns the AMQP message for a publishing, carrying its envelope
+// in the message properties and headers.
+func (out publishing) message(now time.Time) amqp.Publishing {
+	env := out.env
+	if env.ContentType == "" {
+		env.ContentType = defaultContentType
+	}
+
+	msg := amqp.Publishing{
+		ContentType:     env.ContentType,
+		ContentEncoding: env.ContentEncoding,
+		MessageId:       env.MessageID,
+		CorrelationId:   env.CorrelationID,
+		AppId:           env.Origin,
+		Timestamp:       now,
+		Body:            out.body,
+		Headers: amqp.Table{
+			publishTimeHeader: formatNanos(now),
+		},
+	}
+	for header, value := range map[string]string{
+		schemaHeader:      env.SchemaVersion,
+		traceparentHeader: env.TraceParent,
+		tracestateHeader:  env.TraceState,
+		ingestTimeHeader:  formatNanos(env.IngestTime),
+	} {
+		if value != "" {
+			msg.Headers[header] = value
+		}
+	}
+
+	if out.count > 0 {
+		msg.ContentType = "application/octet-stream"
+		msg.MessageId = ""
+		delete(msg.Headers, traceparentHeader)
+		delete(msg.Headers, tracestateHeader)
+		delete(msg.Headers, ingestTimeHeader)
+		msg.Headers[batchHeader] = int32(out.count)
+		msg.Headers[batchContentTypeHeader] = env.ContentType
+
+		for _, f := range perMessage {
+			values := make([]interface{}, len(out.parts))
+			set := false
+			for i := range out.parts {
+				values[i] = f.get(out.parts[i])
+				set = set || values[i] != ""
+			}
+			if set {
+				msg.Headers[f.header] = values
+			}
+		}
+	}
+	return msg
+}
+
+// envelope reads the envelope of a received message.
+func envelope(msg amqp.Delivery) broker.Envelope {
+	schema, _ := msg.Headers[schemaHeader].(string)
+	traceparent, _ := msg.Headers[traceparentHeader].(string)
+	tracestate, _ := msg.Headers[tracestateHeader].(string)
+	ingest, _ := msg.Headers[ingestTimeHeader].(string)
+	ingestTime, err := parseNanos(ingest)
+	if err != nil {
+		utils.Log("amqp: ignoring malformed %s header %q", ingestTimeHeader, ingest)
+	}
+	return broker.Envelope{
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		SchemaVersion:   schema,
+		MessageID:       msg.MessageId,
+		CorrelationID:   msg.CorrelationId,
+		Origin:          msg.AppId,
+		TraceParent:     traceparent,
+		TraceState:      tracestate,
+		IngestTime:      ingestTime,
+	}
+}
+
+// batchable reports whether two messages can be packed into one batch: they
+// must be routed and described alike, apart from per-message fields.
+func batchable(a broker.Message, b broker.Message) bool {
+	return a.Key == b.Key && common(a.Envelope) == common(b.Envelope)
+}
+
+// partEnvelopes returns the envelopes of the messages packed into a batch.
+func partEnvelopes(d *delivery, count int) []broker.Envelope {
+	env := common(d.env)
+	if contentType, ok := d.msg.Headers[batchContentTypeHeader].(string); ok {
+		env.ContentType = contentType
+	}
+
+	envs := make([]broker.Envelope, count)
+	for i := range envs {
+		envs[i] = env
+	}
+	for _, f := range perMessage {
+		values, _ := d.msg.Headers[f.header].([]interface{})
+		for i := 0; i < len(values) && i < count; i++ {
+			value, _ := values[i].(string)
+			f.set(&envs[i], value)
+		}
+	}
+	return envs
+}
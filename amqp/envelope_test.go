@@ -0,0 +1,133 @@
+package amqp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+// received turns a publishing into the delivery a consumer would get
+func received(out publishing) *delivery {
+	msg := out.message(time.Now())
+	d := amqp.Delivery{
+		Acknowledger:    &acknowledger{},
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		MessageId:       msg.MessageId,
+		CorrelationId:   msg.CorrelationId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+	return &delivery{msg: d, env: envelope(d), manual: true}
+}
+
+func TestEnvelope(t *testing.T) {
+	env := broker.Envelope{
+		ContentType:   "application/json",
+		SchemaVersion: "1",
+		MessageID:     "id-1",
+		CorrelationID: "id-0",
+		Origin:        "analytics-test",
+		TraceParent:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		TraceState:    "vendor=value",
+	}
+	if got := received(publishing{body: []byte("{}"), env: env}).Envelope(); got != env {
+		t.Errorf("got envelope %+v, expected %+v", got, env)
+	}
+
+	// Messages published without a content type are plain text, as they
+	// always have been
+	if got := received(publishing{body: []byte("hello")}).Envelope().ContentType; got != "text/plain" {
+		t.Errorf("got content type %q, expected text/plain", got)
+	}
+}
+
+func TestPublishTime(t *testing.T) {
+	now := time.Now()
+	if got := publishTime(received(publishing{body: []byte("{}")}).msg); got.Sub(now) > time.Second || now.Sub(got) > time.Second {
+		t.Errorf("got publish time %s, expected about %s", got, now)
+	}
+
+	// Short headers were once sliced out of range
+	short := amqp.Delivery{Headers: amqp.Table{publishTimeHeader: "12"}}
+	if got := publishTime(short); !got.Equal(time.Unix(0, 12)) {
+		t.Errorf("got publish time %s, expected 12ns after the epoch", got)
+	}
+
+	// Malformed headers fall back on the AMQP timestamp
+	ts := time.Unix(1500000000, 0)
+	for _, header := range []string{"", "not a time", "1500000000x"} {
+		msg := amqp.Delivery{Headers: amqp.Table{publishTimeHeader: header}, Timestamp: ts}
+		if got := publishTime(msg); !got.Equal(ts) {
+			t.Errorf("header %q: got publish time %s, expected %s", header, got, ts)
+		}
+	}
+	if got := publishTime(amqp.Delivery{}); !got.IsZero() {
+		t.Errorf("got publish time %s for a message without one", got)
+	}
+}
+
+func TestIngestTime(t *testing.T) {
+	ingested := time.Unix(1500000000, 123456789)
+	env := broker.Envelope{IngestTime: ingested}
+	if got := received(publishing{body: []byte("{}"), env: env}).Envelope().IngestTime; !got.Equal(ingested) {
+		t.Errorf("got ingest time %s, expected %s", got, ingested)
+	}
+
+	// Messages ingested at different times share a batch, each keeping its
+	// own ingest time
+	messages := make(chan broker.Message, 2)
+	messages <- broker.Message{Body: []byte("a"), Envelope: env}
+	messages <- broker.Message{Body: []byte("b"), Envelope: broker.Envelope{IngestTime: ingested.Add(time.Second)}}
+	close(messages)
+
+	out := <-batch(messages, 10, time.Second)
+	if out.count != 2 {
+		t.Fatalf("got a batch of %d, expected 2", out.count)
+	}
+	var parts []broker.Delivery
+	if err := unbatch(received(out), out.count, func(p broker.Delivery) { parts = append(parts, p) }); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []time.Time{ingested, ingested.Add(time.Second)} {
+		if got := parts[i].Envelope().IngestTime; !got.Equal(expected) {
+			t.Errorf("part %d: got ingest time %s, expected %s", i, got, expected)
+		}
+	}
+}
+
+func TestBatchEnvelopes(t *testing.T) {
+	messages := make(chan broker.Message, 10)
+	env := broker.Envelope{ContentType: "application/json", Origin: "analytics-test"}
+	for _, id := range []string{"a", "b", "c"} {
+		env.MessageID = id
+		env.TraceParent = "trace-" + id
+		messages <- broker.Message{Body: []byte(id), Envelope: env}
+	}
+	// A different content type cannot share the batch
+	messages <- broker.Message{Body: []byte("d"), Envelope: broker.Envelope{MessageID: "d"}}
+	close(messages)
+
+	var outs []publishing
+	for out := range batch(messages, 10, time.Second) {
+		outs = append(outs, out)
+	}
+	if len(outs) != 2 || outs[0].count != 3 || outs[1].count != 1 {
+		t.Fatalf("got %d batches, expected batches of 3 and 1", len(outs))
+	}
+
+	var parts []broker.Delivery
+	d := received(outs[0])
+	if err := unbatch(d, outs[0].count, func(p broker.Delivery) { parts = append(parts, p) }); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"a", "b", "c"} {
+		env := parts[i].Envelope()
+		if env.MessageID != id || env.TraceParent != "trace-"+id || env.ContentType != "application/json" || env.Origin != "analytics-test" {
+			t.Errorf("part %d: got envelope %+v", i, env)
+		}
+	}
+}
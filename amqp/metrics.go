@@ -0,0 +1,46 @@
+package amqp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reconnectAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amqp_reconnect_attempts",
+			Help: "number of attempts to reconnect to the broker after a failure",
+		},
+		[]string{"exchange", "role"},
+	)
+
+	connected = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "amqp_connected",
+			Help: "1 when a session to the broker is established, otherwise 0",
+		},
+		[]string{"exchange", "role"},
+	)
+
+	blocked = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "amqp_blocked",
+			Help: "1 while the broker has blocked publishing, as on a memory or disk alarm, otherwise 0",
+		},
+		[]string{"exchange"},
+	)
+
+	parked = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amqp_messages_parked",
+			Help: "number of messages moved to the parking lot queue after being dead-lettered too often",
+		},
+		[]string{"exchange", "queue"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(reconnectAttempts)
+	prometheus.MustRegister(connected)
+	prometheus.MustRegister(blocked)
+	prometheus.MustRegister(parked)
+}
@@ -0,0 +1,102 @@
+package amqp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/streadway/amqp"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Number of times a message may be dead-lettered before a new sharded
+// consumer parks it
+const DefaultMaxDeaths = 5
+
+// Park messages once they have been dead-lettered max times, rather than
+// handling them again. Messages are never parked if max is 0.
+func (c *AMQPConsumer) SetMaxDeaths(max int) {
+	c.MaxDeaths = max
+}
+
+// deathCount returns the number of times a message has been dead-lettered,
+// summed over the queues and reasons in its x-death header.
+func deathCount(headers amqp.Table) int64 {
+	deaths, _ := headers["x-death"].([]interface{})
+
+	var n int64
+	for _, death := range deaths {
+		if t, ok := death.(amqp.Table); ok {
+			count, _ := t["count"].(int64)
+			n += count
+		}
+	}
+	return n
+}
+
+// poisoned reports whether a message has gone round the dead letter cycle
+// too often to be handled again.
+func (c *AMQPConsumer) poisoned(msg amqp.Delivery) bool {
+	return c.MaxDeaths > 0 && c.ParkingLot != "" && deathCount(msg.Headers) >= int64(c.MaxDeaths)
+}
+
+// How long park waits for the broker to confirm a parked message
+var parkTimeout = 30 * time.Second
+
+// park moves a message to the parking lot queue, where it stays until
+// someone looks at it. The message is acked only once the broker has
+// confirmed it is parked, and otherwise returned to its queue.
+func (c *AMQPConsumer) park(sub AMQPSession, d *delivery, queue string) {
+	msg := d.msg
+	if err := publishConfirmed(sub.Connection,
+		"",           // default exchange, routing to the queue by name
+		c.ParkingLot, // routing key
+		amqp.Publishing{
+			Headers:         msg.Headers,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			DeliveryMode:    amqp.Persistent,
+			MessageId:       msg.MessageId,
+			CorrelationId:   msg.CorrelationId,
+			Timestamp:       msg.Timestamp,
+			Body:            msg.Body,
+		},
+	); err != nil {
+		utils.Log("amqp: failed to park message from %s, returning it to the queue: %v", queue, err)
+		d.Nack()
+		return
+	}
+
+	utils.Log("amqp: parked message from %s on %s after %d dead-letterings", queue, c.ParkingLot, deathCount(msg.Headers))
+	parked.With(prometheus.Labels{"exchange": c.Exchange, "queue": queue}).Inc()
+	d.Ack()
+}
+
+// publishConfirmed publishes a message on a channel of its own in confirm
+// mode, and waits for the broker to confirm it.
+func publishConfirmed(conn Connection, exchange string, key string, msg amqp.Publishing) error {
+	return onChannel(conn, func(ch Channel) error {
+		if err := ch.Confirm(false); err != nil {
+			return err
+		}
+		confirm := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+		if err := ch.Publish(exchange, key, false, false, msg); err != nil {
+			return err
+		}
+
+		select {
+		case confirmed, ok := <-confirm:
+			if !ok {
+				return errors.New("channel closed before the broker confirmed the message")
+			}
+			if !confirmed.Ack {
+				return errors.New("broker nacked the message")
+			}
+			return nil
+		case <-time.After(parkTimeout):
+			return fmt.Errorf("broker did not confirm the message within %s", parkTimeout)
+		}
+	})
+}
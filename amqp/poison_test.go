@@ -0,0 +1,74 @@
+package amqp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestPoisoned(t *testing.T) {
+	c := &AMQPConsumer{ParkingLot: "analytics-test-parking-lot", MaxDeaths: 3}
+
+	cycled := func(expired int64, rejected int64) amqp.Delivery {
+		return amqp.Delivery{Headers: amqp.Table{"x-death": []interface{}{
+			amqp.Table{"count": rejected, "reason": "rejected", "queue": "analytics-test-dlq"},
+			amqp.Table{"count": expired, "reason": "expired", "queue": "host1"},
+		}}}
+	}
+
+	if c.poisoned(amqp.Delivery{}) {
+		t.Error("message never dead-lettered is poisoned")
+	}
+	if c.poisoned(cycled(1, 1)) {
+		t.Error("message dead-lettered twice is poisoned")
+	}
+	if !c.poisoned(cycled(2, 1)) {
+		t.Error("message dead-lettered three times is not poisoned")
+	}
+
+	c.SetMaxDeaths(0)
+	if c.poisoned(cycled(10, 10)) {
+		t.Error("message poisoned with parking disabled")
+	}
+}
+
+func TestPark(t *testing.T) {
+	defer func(timeout time.Duration) { parkTimeout = timeout }(parkTimeout)
+	parkTimeout = 10 * time.Millisecond
+
+	c := &AMQPConsumer{ParkingLot: "analytics-test-parking-lot", MaxDeaths: 3}
+	b := newFakeBroker()
+	conn, err := b.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := AMQPSession{ch, conn}
+
+	park := func(confirm func(fakePublishing) (bool, bool)) string {
+		b.confirm = confirm
+		a := &acknowledger{}
+		c.park(sub, &delivery{msg: amqp.Delivery{Acknowledger: a, Body: []byte("poison")}, manual: true}, "host1")
+		if p := b.next(t); p.key != c.ParkingLot || p.tag == 0 {
+			t.Errorf("published to %q with tag %d, expected a confirmed publish to the parking lot", p.key, p.tag)
+		}
+		return strings.Join(a.settled, " ")
+	}
+
+	// The message is acked once the broker confirms it is parked, and
+	// otherwise left on its queue
+	if got := park(nil); got != "ack" {
+		t.Errorf("confirmed: got %q, expected ack", got)
+	}
+	if got := park(func(fakePublishing) (bool, bool) { return false, true }); got != "nack" {
+		t.Errorf("nacked by the broker: got %q, expected nack", got)
+	}
+	if got := park(func(fakePublishing) (bool, bool) { return true, false }); got != "nack" {
+		t.Errorf("unconfirmed: got %q, expected nack", got)
+	}
+}
@@ -0,0 +1,201 @@
+package amqp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// QueueOptions are the arguments a sharded consumer declares its queue and
+// sharded exchange with. Every replica of an analytic must use the same
+// options, or declaring the shared exchange fails.
+type QueueOptions struct {
+	// Time a message may wait on the queue before it is dead-lettered,
+	// x-message-ttl, none if 0
+	MessageTTL time.Duration
+	// Time the queue is kept once unused, x-expires, forever if 0
+	Expires time.Duration
+	// Messages held on the queue, x-max-length, unlimited if 0
+	MaxLength int
+	// What happens to messages beyond MaxLength: drop-head, reject-publish
+	// or reject-publish-dlx, x-overflow
+	Overflow string
+	// Queue type: classic, quorum or stream, x-queue-type, the broker's
+	// default if unset. Quorum and stream queues must be persistent.
+	Type string
+
+	// Type of the sharded exchange, such as x-random or x-consistent-hash
+	ExchangeType string
+}
+
+// The queue options for a new consumer
+var DefaultQueueOptions = QueueOptions{
+	MessageTTL:   10 * time.Second,
+	Expires:      30 * time.Second,
+	ExchangeType: "x-random",
+}
+
+// Set the options sharded queues are declared with.
+func (c *AMQPConsumer) SetQueueOptions(opts QueueOptions) {
+	c.Queue = opts
+}
+
+// Rather than declaring its exchanges, queues and the bindings between them,
+// check that they already exist as the consumer would declare them. A
+// consumer which finds missing or mismatched ones fails, listing them all.
+// Only the replica queue, which belongs to this instance of the analytic,
+// is still declared and bound to the sharded exchange.
+func (c *AMQPConsumer) SetVerify(verify bool) {
+	c.Verify = verify
+	c.Passive = verify
+}
+
+func (o QueueOptions) validate(persistent bool) error {
+	switch o.Type {
+	case "", "classic":
+	case "quorum", "stream":
+		if !persistent {
+			return fmt.Errorf("%s queues must be persistent", o.Type)
+		}
+	default:
+		return fmt.Errorf("unknown queue type %q", o.Type)
+	}
+
+	switch o.Overflow {
+	case "", "drop-head", "reject-publish":
+	case "reject-publish-dlx":
+		if o.Type == "quorum" {
+			return fmt.Errorf("quorum queues do not support overflow %q", o.Overflow)
+		}
+	default:
+		return fmt.Errorf("unknown overflow policy %q", o.Overflow)
+	}
+
+	if o.Type == "stream" && (o.MessageTTL > 0 || o.Expires > 0 || o.Overflow != "") {
+		return fmt.Errorf("stream queues take no message TTL, expiry or overflow policy")
+	}
+	return nil
+}
+
+// args returns the queue arguments for the options, dead-lettering through
+// dlx.
+func (o QueueOptions) args(dlx string) amqp.Table {
+	args := amqp.Table{"x-dead-letter-exchange": dlx}
+	if o.Expires > 0 {
+		args["x-expires"] = int32(o.Expires / time.Millisecond)
+	}
+	if o.MessageTTL > 0 {
+		args["x-message-ttl"] = int32(o.MessageTTL / time.Millisecond)
+	}
+	if o.MaxLength > 0 {
+		args["x-max-length"] = int32(o.MaxLength)
+	}
+	if o.Overflow != "" {
+		args["x-overflow"] = o.Overflow
+	}
+	if o.Type != "" {
+		args["x-queue-type"] = o.Type
+	}
+	return args
+}
+
+// shardKey is the key queues are bound to the sharded exchange with. A
+// consistent hash exchange takes it as the queue's weight.
+func (o QueueOptions) shardKey() string {
+	if o.ExchangeType == "x-consistent-hash" {
+		return "1"
+	}
+	return ""
+}
+
+// declaration declares one exchange or queue, or with passive set checks
+// that it exists.
+type declaration struct {
+	what    string
+	name    string
+	declare func(ch Channel, passive bool) error
+	// Belonging to one instance of the analytic, so declared even when
+	// verifying
+	instance bool
+}
+
+func exchangeDeclaration(what string, name string, kind string, internal bool, args amqp.Table) declaration {
+	return declaration{what: what, name: name, declare: func(ch Channel, passive bool) error {
+		declare := ch.ExchangeDeclare
+		if passive {
+			declare = ch.ExchangeDeclarePassive
+		}
+		return declare(
+			name,     // name
+			kind,     // type
+			true,     // durable
+			false,    // auto-deleted
+			internal, // internal
+			false,    // no-wait
+			args,     // arguments
+		)
+	}}
+}
+
+func queueDeclaration(what string, name string, durable bool, args amqp.Table) declaration {
+	return declaration{what: what, name: name, declare: func(ch Channel, passive bool) error {
+		declare := ch.QueueDeclare
+		if passive {
+			declare = ch.QueueDeclarePassive
+		}
+		_, err := declare(
+			name,     // name
+			durable,  // durable
+			!durable, // delete when unused
+			!durable, // exclusive
+			false,    // no-wait
+			args,     // arguments
+		)
+		return err
+	}}
+}
+
+// onChannel runs f on a channel of its own, since a failed declaration
+// closes the channel it was made on.
+func onChannel(conn Connection, f func(ch Channel) error) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return f(ch)
+}
+
+// verify checks each declaration against what the broker already has,
+// without creating anything, and returns an error listing every exchange
+// or queue which is missing or declared with other settings.
+func verify(conn Connection, decls []declaration) error {
+	var problems []string
+	for _, d := range decls {
+		err := onChannel(conn, func(ch Channel) error { return d.declare(ch, true) })
+		if err == nil {
+			// Declaring an existing exchange or queue with the same settings
+			// changes nothing, and the broker says which setting differs
+			// when they are not
+			err = onChannel(conn, func(ch Channel) error { return d.declare(ch, false) })
+		}
+		if err == nil {
+			continue
+		}
+
+		if e, ok := err.(*amqp.Error); ok && e.Code == amqp.NotFound {
+			problems = append(problems, fmt.Sprintf("%s %q does not exist", d.what, d.name))
+		} else if ok && e.Code == amqp.PreconditionFailed {
+			problems = append(problems, fmt.Sprintf("%s %q: %s", d.what, d.name, e.Reason))
+		} else {
+			problems = append(problems, fmt.Sprintf("%s %q: %v", d.what, d.name, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("topology does not match: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+func TestQueueOptionsArgs(t *testing.T) {
+	got := fmt.Sprint(DefaultQueueOptions.args("analytics-test-dlx"))
+	expected := "map[x-dead-letter-exchange:analytics-test-dlx x-expires:30000 x-message-ttl:10000]"
+	if got != expected {
+		t.Errorf("default arguments: got %s, expected %s", got, expected)
+	}
+
+	opts := QueueOptions{MaxLength: 5000, Overflow: "reject-publish", Type: "quorum"}
+	got = fmt.Sprint(opts.args("analytics-test-dlx"))
+	expected = "map[x-dead-letter-exchange:analytics-test-dlx x-max-length:5000 x-overflow:reject-publish x-queue-type:quorum]"
+	if got != expected {
+		t.Errorf("got %s, expected %s", got, expected)
+	}
+}
+
+func TestQueueOptionsValidate(t *testing.T) {
+	for _, test := range []struct {
+		opts       QueueOptions
+		persistent bool
+		valid      bool
+	}{
+		{DefaultQueueOptions, false, true},
+		{QueueOptions{Type: "quorum", Overflow: "drop-head"}, true, true},
+		{QueueOptions{Type: "quorum"}, false, false},
+		{QueueOptions{Type: "quorum", Overflow: "reject-publish-dlx"}, true, false},
+		{QueueOptions{Type: "stream"}, true, true},
+		{QueueOptions{Type: "stream", MessageTTL: time.Second}, true, false},
+		{QueueOptions{Type: "lazy"}, true, false},
+		{QueueOptions{Overflow: "drop-tail"}, true, false},
+	} {
+		err := test.opts.validate(test.persistent)
+		if (err == nil) != test.valid {
+			t.Errorf("%+v, persistent %v: got error %v", test.opts, test.persistent, err)
+		}
+	}
+}
+
+// verifying returns a sharded consumer verifying its topology on the fake
+// broker, and a session to it
+func verifying(t *testing.T, ctx context.Context, b *fakeBroker) (*AMQPConsumer, AMQPSession) {
+	c := NewShardedConsumer(ctx, "analytics-test", "events", "amqp://fake/", 10, true)
+	c.SetVerify(true)
+	b.client(&c.AMQPClient)
+
+	conn, err := b.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, AMQPSession{ch, conn}
+}
+
+func TestVerify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := newFakeBroker()
+	for _, name := range []string{"events", "analytics-test", "analytics-test-dlx", "analytics-test-dlq", "analytics-test-parking-lot"} {
+		b.exists[name] = true
+	}
+	c, sess := verifying(t, ctx, b)
+	if err := c.declareAndBindQ(sess); err != nil {
+		t.Fatal(err)
+	}
+
+	// The shared topology is checked, and left alone. Only the replica
+	// queue, which a new instance cannot find, is declared and bound.
+	expected := []string{
+		"QueueDeclare " + c.QueueName,
+		"QueueBind " + c.QueueName + "  analytics-test",
+	}
+	if got := b.recorded(""); strings.Join(got, "; ") != strings.Join(expected, "; ") {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
+
+func TestVerifyMissing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := newFakeBroker()
+	b.exists["analytics-test"] = true
+	c, _ := verifying(t, ctx, b)
+
+	// Consuming stops, naming what is missing, rather than redialling
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Consume(ctx, func(broker.Delivery) {})
+	}()
+	select {
+	case err := <-done:
+		if err == nil ||
+			!strings.Contains(err.Error(), `event type exchange "events" does not exist`) ||
+			!strings.Contains(err.Error(), `dead letter queue "analytics-test-dlq" does not exist`) ||
+			strings.Contains(err.Error(), c.QueueName) {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still consuming with the exchange missing")
+	}
+	if got := b.recorded(""); len(got) > 0 {
+		t.Errorf("changed the topology while verifying: %q", got)
+	}
+}
@@ -0,0 +1,123 @@
+package amqp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// TLSConfig names the files used for a TLS connection to the broker, which
+// must be given an amqps:// URL.
+type TLSConfig struct {
+	// PEM bundle of CAs trusted to sign the broker's certificate, the
+	// system roots if empty
+	CAFile string
+	// PEM client certificate and key, for mutual TLS
+	CertFile string
+	KeyFile  string
+	// Name expected on the broker's certificate, the URL host if empty
+	ServerName string
+
+	// Authenticate with the client certificate using SASL EXTERNAL, rather
+	// than the user and password in the URL
+	External bool
+}
+
+// TLSConfigFromEnv reads the TLS settings from AMQP_TLS_CA, AMQP_TLS_CERT,
+// AMQP_TLS_KEY, AMQP_TLS_SERVER_NAME and AMQP_AUTH_EXTERNAL ("true" to use
+// SASL EXTERNAL). It returns nil if none are set.
+func TLSConfigFromEnv() *TLSConfig {
+	t := &TLSConfig{
+		CAFile:     utils.Getenv("AMQP_TLS_CA", ""),
+		CertFile:   utils.Getenv("AMQP_TLS_CERT", ""),
+		KeyFile:    utils.Getenv("AMQP_TLS_KEY", ""),
+		ServerName: utils.Getenv("AMQP_TLS_SERVER_NAME", ""),
+		External:   utils.Getenv("AMQP_AUTH_EXTERNAL", "false") == "true",
+	}
+	if *t == (TLSConfig{}) {
+		return nil
+	}
+	return t
+}
+
+// Client loads the files into a tls.Config. They are read on every
+// connection, so renewed certificates are picked up when reconnecting.
+func (t *TLSConfig) Client() (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: t.ServerName}
+
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA bundle: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", t.CAFile)
+		}
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if t.External && len(cfg.Certificates) == 0 {
+		return nil, errors.New("EXTERNAL authentication needs a client certificate")
+	}
+
+	return cfg, nil
+}
+
+// externalAuth is the SASL EXTERNAL mechanism, where the broker takes the
+// identity from the client certificate.
+type externalAuth struct{}
+
+func (externalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+func (externalAuth) Response() string {
+	return ""
+}
+
+// dial connects to the broker, over TLS if the client has a TLS config
+func (c *AMQPClient) dial() (*amqp.Connection, error) {
+	return Dial(c.Broker, c.TLS)
+}
+
+// Dial connects to the broker URL as publishers and consumers do, over TLS
+// if tlsConfig is not nil, for tools which need a connection of their own.
+func Dial(broker string, tlsConfig *TLSConfig) (*amqp.Connection, error) {
+	if tlsConfig == nil {
+		return amqp.Dial(broker)
+	}
+
+	if !strings.HasPrefix(broker, "amqps://") {
+		return nil, errors.New("TLS is configured, but the broker URL is not amqps://")
+	}
+
+	cfg, err := tlsConfig.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	config := amqp.Config{
+		Heartbeat:       10 * time.Second,
+		Locale:          "en_US",
+		TLSClientConfig: cfg,
+	}
+	if tlsConfig.External {
+		config.SASL = []amqp.Authentication{externalAuth{}}
+	}
+	return amqp.DialConfig(broker, config)
+}
@@ -0,0 +1,76 @@
+package amqp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate and its key to dir
+func writeCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "analytic"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqp-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCert(t, dir)
+
+	tc := &TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "broker", External: true}
+	cfg, err := tc.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerName != "broker" || len(cfg.Certificates) != 1 || cfg.RootCAs == nil {
+		t.Errorf("incomplete tls.Config: %+v", cfg)
+	}
+
+	if _, err := (&TLSConfig{CAFile: keyFile}).Client(); err == nil {
+		t.Error("CA bundle without certificates loaded without error")
+	}
+	if _, err := (&TLSConfig{External: true}).Client(); err == nil {
+		t.Error("EXTERNAL authentication without a certificate accepted")
+	}
+
+	c := &AMQPClient{Broker: "amqp://broker/", TLS: tc}
+	if _, err := c.dial(); err == nil {
+		t.Error("TLS dial to an amqp:// URL accepted")
+	}
+}
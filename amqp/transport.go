@@ -0,0 +1,146 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+var (
+	_ broker.Transport = (*Transport)(nil)
+	_ broker.Publisher = (*AMQPPublisher)(nil)
+	_ broker.Consumer  = (*AMQPConsumer)(nil)
+)
+
+func init() {
+	broker.RegisterOutputBackend("amqp", outputBackend)
+}
+
+// Transport creates publishers and sharded consumers, all connected to the
+// same broker. Publishers use fanout exchanges, except for endpoints with a
+// routing key, "exchange/routingkey", which use RoutedExchangeType.
+// Likewise consumers of an input "exchange/filter" bind to an exchange of
+// RoutedExchangeType with the filter, as described by parseBindings.
+type Transport struct {
+	Broker     string
+	Prefetch   int
+	Persistent bool
+
+	// Exchange type for endpoints with a routing key: topic, direct or
+	// headers
+	RoutedExchangeType string
+	// How the headers in a headers exchange filter match, "all" or "any"
+	HeadersMatch string
+
+	// Maximum number of unconfirmed messages per publisher
+	MaxInFlight int
+	// Messages packed into each AMQP message, and how long to wait for a
+	// batch to fill; batching is off when BatchSize is below two
+	BatchSize   int
+	BatchLinger time.Duration
+
+	// Retrying while the broker cannot be reached
+	Backoff Backoff
+	// Connecting over TLS, if set
+	TLS *TLSConfig
+
+	// Acknowledge messages in batches as they arrive, rather than once
+	// each has been handled.
+	BatchAck bool
+
+	// Arguments for sharded queues
+	Queue QueueOptions
+	// Check exchanges and queues exist as consumers would declare them,
+	// rather than declaring them
+	Verify bool
+	// Times a message may be dead-lettered before it is parked, never if 0
+	MaxDeaths int
+}
+
+// Return a transport for the broker URL with the defaults used by workers:
+// a high prefetch (as long as the broker/analytic has memory for it) and
+// persistent queues.
+func NewTransport(broker string) *Transport {
+	return &Transport{
+		Broker:      broker,
+		Prefetch:    1000,
+		Persistent:  true,
+		MaxInFlight: DefaultMaxInFlight,
+		Backoff:     DefaultBackoff,
+		Queue:       DefaultQueueOptions,
+		MaxDeaths:   DefaultMaxDeaths,
+
+		RoutedExchangeType: "topic",
+	}
+}
+
+func (t *Transport) Name() string {
+	return "amqp"
+}
+
+func (t *Transport) NewPublisher(ctx context.Context, endpoint string) broker.Publisher {
+	exchange, key, routed := broker.SplitEndpoint(endpoint)
+	p := NewPublisher(ctx, exchange, t.Broker)
+	if routed {
+		p.SetRouting(t.RoutedExchangeType, key)
+	}
+	p.SetMaxInFlight(t.MaxInFlight)
+	p.SetBatching(t.BatchSize, t.BatchLinger)
+	p.Backoff = t.Backoff
+	p.TLS = t.TLS
+	return p
+}
+
+func (t *Transport) NewConsumer(ctx context.Context, name string, input string) broker.Consumer {
+	exchange, filter, routed := broker.SplitEndpoint(input)
+	c := NewShardedConsumer(ctx, name, exchange, t.Broker, t.Prefetch, t.Persistent)
+	if routed {
+		c.SetBindings(t.RoutedExchangeType, parseBindings(t.RoutedExchangeType, filter, t.HeadersMatch)...)
+	}
+	c.SetBatchAck(t.BatchAck)
+	c.SetQueueOptions(t.Queue)
+	c.SetVerify(t.Verify)
+	c.SetMaxDeaths(t.MaxDeaths)
+	c.Backoff = t.Backoff
+	c.TLS = t.TLS
+	return c
+}
+
+// outputBackend publishes to an exchange on the worker's broker, named by
+// "amqp://exchange", optionally with a default routing key,
+// "amqp://exchange?routing=key". The worker's transport must be AMQP.
+func outputBackend(u *url.URL, active broker.Transport) (broker.Transport, string, error) {
+	if _, ok := active.(*Transport); !ok {
+		return nil, "", fmt.Errorf("%s needs the AMQP transport, but the worker's is %s",
+			u.Redacted(), active.Name())
+	}
+	if u.Host == "" {
+		return nil, "", fmt.Errorf("no exchange given in %s, expected amqp://exchange", u.Redacted())
+	}
+	if u.User != nil || u.Port() != "" || (u.Path != "" && u.Path != "/") {
+		return nil, "", fmt.Errorf("%s is not an exchange, expected amqp://exchange?routing=key", u.Redacted())
+	}
+
+	query := u.Query()
+	key := query.Get("routing")
+	delete(query, "routing")
+	if len(query) > 0 {
+		var params []string
+		for param := range query {
+			params = append(params, param)
+		}
+		sort.Strings(params)
+		return nil, "", fmt.Errorf("unknown parameters %s in %s, expected routing",
+			strings.Join(params, ", "), u.Redacted())
+	}
+
+	if key == "" {
+		return active, u.Host, nil
+	}
+	return active, u.Host + "/" + key, nil
+}
@@ -0,0 +1,106 @@
+// The broker package defines the transport-agnostic interfaces which the
+// worker package uses to receive and send messages. Analytics should never
+// need to know which messaging system sits behind a QueueWorker or an
+// OutputSet; each messaging system implements a Transport and the worker
+// picks one at start-up.
+//
+// Transport packages register themselves from init, so that a binary offers
+// only the transports it imports, if only for their side effects:
+//
+//	import _ "github.com/trustnetworks/analytics-common/kafka"
+
+package broker
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Envelope is the metadata carried with a message body.
+type Envelope struct {
+	ContentType     string
+	ContentEncoding string
+	// Version of the datatypes.Event schema the body follows, if it is an
+	// event
+	SchemaVersion string
+	MessageID     string
+	// ID of the message this one was derived from or answers
+	CorrelationID string
+	// Analytic which published the message, its worker.Pgm
+	Origin string
+	// W3C trace context of the span which sent the message
+	TraceParent string
+	TraceState  string
+	// When the event the message derives from was first ingested, which
+	// analytics pass on to measure end-to-end latency
+	IngestTime time.Time
+}
+
+// Message is a message to publish. Key is its routing key; when empty, the
+// publisher uses the routing key given in its endpoint, if any.
+type Message struct {
+	Body []byte
+	Key  string
+	Envelope
+}
+
+// Publisher sends every message read from the channel to its destination,
+// returning nil once the channel has been closed and drained, or an error
+// when the transport can no longer deliver.
+type Publisher interface {
+	Publish(messages <-chan Message) error
+}
+
+// Delivery is a message received from a Consumer, along with the time it
+// was published, its envelope and routing key. It is settled with one of Ack, Nack or
+// Reject once the message has been processed. Transports which acknowledge
+// in batches settle deliveries themselves, and these calls do nothing.
+type Delivery interface {
+	Body() []byte
+	Timestamp() time.Time
+	Envelope() Envelope
+	// Key is the routing key the message was published with, if any.
+	Key() string
+
+	// Ack tells the transport the message has been processed.
+	Ack() error
+	// Nack returns the message to its queue to be delivered again.
+	Nack() error
+	// Reject discards the message, dead-lettering it where the queue has a
+	// dead letter exchange.
+	Reject() error
+}
+
+// Consumer passes each delivery to the handle function until ctx is done,
+// when it returns nil, or the transport fails. Once it has returned, handle
+// is not called again, but deliveries can still be settled until the
+// context the consumer was created with is done.
+type Consumer interface {
+	Consume(ctx context.Context, handle func(Delivery)) error
+}
+
+// Transport creates publishers and consumers for one messaging system.
+type Transport interface {
+	Name() string
+	// NewPublisher returns a publisher to the exchange named by an output
+	// endpoint, which may carry a default routing key, see SplitEndpoint.
+	// ctx bounds the lifetime of its connection.
+	NewPublisher(ctx context.Context, exchange string) Publisher
+	// NewConsumer returns a consumer of the exchange named by a worker
+	// input, one of the group of consumers called name sharing the work,
+	// which is normally derived from the analytic name. ctx bounds the
+	// lifetime of its connection.
+	NewConsumer(ctx context.Context, name string, exchange string) Consumer
+}
+
+// SplitEndpoint splits an output endpoint of the form "exchange/routingkey"
+// into the exchange and routing key. routed reports whether the endpoint has
+// a routing key part at all: "events/" names an exchange where every message
+// is routed by its own key.
+func SplitEndpoint(endpoint string) (exchange string, key string, routed bool) {
+	if i := strings.Index(endpoint, "/"); i >= 0 {
+		return endpoint[:i], endpoint[i+1:], true
+	}
+	return endpoint, "", false
+}
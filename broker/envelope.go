@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"strconv"
+	"time"
+)
+
+// Names of the headers carrying the envelope on transports with no message
+// properties for it. They match the headers AMQP carries the fields it has
+// no property for in, and the trace headers are those W3C trace context
+// defines.
+const (
+	ContentTypeHeader     = "content_type"
+	ContentEncodingHeader = "content_encoding"
+	SchemaVersionHeader   = "schema_version"
+	MessageIDHeader       = "message_id"
+	CorrelationIDHeader   = "correlation_id"
+	OriginHeader          = "origin"
+	TraceParentHeader     = "traceparent"
+	TraceStateHeader      = "tracestate"
+	// When the event was first ingested, in nanoseconds since the epoch
+	IngestTimeHeader = "ingest_timestamp_in_ns"
+)
+
+var envelopeHeaders = []struct {
+	name string
+	get  func(Envelope) string
+	set  func(*Envelope, string)
+}{
+	{
+		ContentTypeHeader,
+		func(e Envelope) string { return e.ContentType },
+		func(e *Envelope, s string) { e.ContentType = s },
+	},
+	{
+		ContentEncodingHeader,
+		func(e Envelope) string { return e.ContentEncoding },
+		func(e *Envelope, s string) { e.ContentEncoding = s },
+	},
+	{
+		SchemaVersionHeader,
+		func(e Envelope) string { return e.SchemaVersion },
+		func(e *Envelope, s string) { e.SchemaVersion = s },
+	},
+	{
+		MessageIDHeader,
+		func(e Envelope) string { return e.MessageID },
+		func(e *Envelope, s string) { e.MessageID = s },
+	},
+	{
+		CorrelationIDHeader,
+		func(e Envelope) string { return e.CorrelationID },
+		func(e *Envelope, s string) { e.CorrelationID = s },
+	},
+	{
+		OriginHeader,
+		func(e Envelope) string { return e.Origin },
+		func(e *Envelope, s string) { e.Origin = s },
+	},
+	{
+		TraceParentHeader,
+		func(e Envelope) string { return e.TraceParent },
+		func(e *Envelope, s string) { e.TraceParent = s },
+	},
+	{
+		TraceStateHeader,
+		func(e Envelope) string { return e.TraceState },
+		func(e *Envelope, s string) { e.TraceState = s },
+	},
+	{
+		IngestTimeHeader,
+		func(e Envelope) string {
+			if e.IngestTime.IsZero() {
+				return ""
+			}
+			return strconv.FormatInt(e.IngestTime.UnixNano(), 10)
+		},
+		func(e *Envelope, s string) {
+			if ns, err := strconv.ParseInt(s, 10, 64); err == nil {
+				e.IngestTime = time.Unix(0, ns)
+			}
+		},
+	},
+}
+
+// SetHeaders passes set the header for each field of the envelope which is
+// set, in the same order every time.
+func (e Envelope) SetHeaders(set func(name string, value string)) {
+	for _, h := range envelopeHeaders {
+		if value := h.get(e); value != "" {
+			set(h.name, value)
+		}
+	}
+}
+
+// EnvelopeFromHeaders reads an envelope from the headers of a message, which
+// get returns, or "" for those the message does not have.
+func EnvelopeFromHeaders(get func(name string) string) Envelope {
+	var env Envelope
+	for _, h := range envelopeHeaders {
+		if value := get(h.name); value != "" {
+			h.set(&env, value)
+		}
+	}
+	return env
+}
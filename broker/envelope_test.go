@@ -0,0 +1,36 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvelopeHeaders(t *testing.T) {
+	env := Envelope{
+		ContentType:   "application/json",
+		SchemaVersion: "1",
+		MessageID:     "id-1",
+		TraceParent:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		IngestTime:    time.Unix(1500000000, 123456789),
+	}
+
+	// Only the fields which are set travel
+	headers := map[string]string{}
+	var names []string
+	env.SetHeaders(func(name string, value string) {
+		headers[name] = value
+		names = append(names, name)
+	})
+	if len(names) != 5 || headers[MessageIDHeader] != "id-1" || headers[IngestTimeHeader] != "1500000000123456789" {
+		t.Errorf("got headers %v", headers)
+	}
+
+	got := EnvelopeFromHeaders(func(name string) string { return headers[name] })
+	if !got.IngestTime.Equal(env.IngestTime) {
+		t.Errorf("got ingest time %s, expected %s", got.IngestTime, env.IngestTime)
+	}
+	got.IngestTime = env.IngestTime
+	if got != env {
+		t.Errorf("got envelope %+v, expected %+v", got, env)
+	}
+}
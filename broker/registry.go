@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OutputBackend returns the transport publishing to an output endpoint of
+// its scheme, "scheme:...", and the endpoint which that transport's
+// publishers take. active is the transport the worker was started with.
+type OutputBackend func(endpoint *url.URL, active Transport) (Transport, string, error)
+
+// InputBackend returns the transport consuming a worker input of its
+// scheme, "scheme:...", and the exchange which that transport's consumers
+// take.
+type InputBackend func(input *url.URL) (Transport, string, error)
+
+// TransportFromEnv returns the transport which the environment configures,
+// or nil if it configures none.
+type TransportFromEnv func() Transport
+
+var (
+	registryMu     sync.RWMutex
+	outputBackends = make(map[string]OutputBackend)
+	inputBackends  = make(map[string]InputBackend)
+	transports     = make(map[string]TransportFromEnv)
+)
+
+// RegisterOutputBackend makes outputs whose endpoints have the scheme
+// publish through the backend. It panics if the scheme already has one.
+func RegisterOutputBackend(scheme string, b OutputBackend) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	scheme = strings.ToLower(scheme)
+	if _, ok := outputBackends[scheme]; ok {
+		panic(fmt.Sprintf("broker: output backend for %q registered twice", scheme))
+	}
+	outputBackends[scheme] = b
+}
+
+// RegisterInputBackend makes inputs with the scheme consume through the
+// backend. It panics if the scheme already has one.
+func RegisterInputBackend(scheme string, b InputBackend) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	scheme = strings.ToLower(scheme)
+	if _, ok := inputBackends[scheme]; ok {
+		panic(fmt.Sprintf("broker: input backend for %q registered twice", scheme))
+	}
+	inputBackends[scheme] = b
+}
+
+// RegisterTransport offers the transport which the environment configures
+// to workers which were not given one. It panics if the name is already
+// registered.
+func RegisterTransport(name string, fromEnv TransportFromEnv) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := transports[name]; ok {
+		panic(fmt.Sprintf("broker: transport %q registered twice", name))
+	}
+	transports[name] = fromEnv
+}
+
+// GetOutputBackend returns the backend for outputs with the scheme.
+func GetOutputBackend(scheme string) (OutputBackend, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	b, ok := outputBackends[strings.ToLower(scheme)]
+	return b, ok
+}
+
+// GetInputBackend returns the backend for inputs with the scheme.
+func GetInputBackend(scheme string) (InputBackend, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	b, ok := inputBackends[strings.ToLower(scheme)]
+	return b, ok
+}
+
+// OutputSchemes returns the schemes with output backends, in order.
+func OutputSchemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	var s []string
+	for scheme := range outputBackends {
+		s = append(s, scheme)
+	}
+	sort.Strings(s)
+	return s
+}
+
+// InputSchemes returns the schemes with input backends, in order.
+func InputSchemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	var s []string
+	for scheme := range inputBackends {
+		s = append(s, scheme)
+	}
+	sort.Strings(s)
+	return s
+}
+
+// EnvTransport returns the first registered transport, in name order, which
+// the environment configures, or nil if it configures none.
+func EnvTransport() Transport {
+	registryMu.RLock()
+	var names []string
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fromEnv := make([]TransportFromEnv, len(names))
+	for i, name := range names {
+		fromEnv[i] = transports[name]
+	}
+	registryMu.RUnlock()
+
+	for _, f := range fromEnv {
+		if t := f(); t != nil {
+			return t
+		}
+	}
+	return nil
+}
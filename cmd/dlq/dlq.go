@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	streadway "github.com/streadway/amqp"
+)
+
+// death is one entry of the x-death header the broker adds each time a
+// message is dead-lettered, most recent first.
+type death struct {
+	Count       int64     `json:"count"`
+	Reason      string    `json:"reason"`
+	Queue       string    `json:"queue"`
+	Exchange    string    `json:"exchange"`
+	RoutingKeys []string  `json:"routing_keys,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// record is a dead-lettered message as dump writes it. The body is given as
+// a string, or base64 encoded if it is not UTF-8.
+type record struct {
+	Queue      string                 `json:"queue"`
+	Exchange   string                 `json:"exchange"`
+	RoutingKey string                 `json:"routing_key"`
+	Headers    map[string]interface{} `json:"headers,omitempty"`
+	Deaths     []death                `json:"x_death,omitempty"`
+	Body       string                 `json:"body,omitempty"`
+	BodyBase64 []byte                 `json:"body_base64,omitempty"`
+}
+
+// deaths decodes the x-death header, if there is one.
+func deaths(headers streadway.Table) []death {
+	entries, _ := headers["x-death"].([]interface{})
+
+	var ds []death
+	for _, entry := range entries {
+		t, ok := entry.(streadway.Table)
+		if !ok {
+			continue
+		}
+		var d death
+		d.Count, _ = t["count"].(int64)
+		d.Reason, _ = t["reason"].(string)
+		d.Queue, _ = t["queue"].(string)
+		d.Exchange, _ = t["exchange"].(string)
+		d.Time, _ = t["time"].(time.Time)
+		keys, _ := t["routing-keys"].([]interface{})
+		for _, key := range keys {
+			if k, ok := key.(string); ok {
+				d.RoutingKeys = append(d.RoutingKeys, k)
+			}
+		}
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+// deathHeader reports whether a header is one the broker adds when
+// dead-lettering, which is dropped when the message is replayed.
+func deathHeader(name string) bool {
+	return name == "x-death" || strings.HasPrefix(name, "x-first-death-") || strings.HasPrefix(name, "x-last-death-")
+}
+
+func newRecord(queue string, d streadway.Delivery) record {
+	r := record{
+		Queue:      queue,
+		Exchange:   d.Exchange,
+		RoutingKey: d.RoutingKey,
+		Deaths:     deaths(d.Headers),
+	}
+	for name, value := range d.Headers {
+		if name == "x-death" {
+			continue
+		}
+		if r.Headers == nil {
+			r.Headers = make(map[string]interface{})
+		}
+		r.Headers[name] = value
+	}
+	if utf8.Valid(d.Body) {
+		r.Body = string(d.Body)
+	} else {
+		r.BodyBase64 = d.Body
+	}
+	return r
+}
+
+// origin returns the exchange and routing key a message was first published
+// with. Messages which were never routed to a queue reach the DLQ through
+// the alternate exchange without an x-death header, still carrying them.
+func origin(d streadway.Delivery) (string, string) {
+	ds := deaths(d.Headers)
+	if len(ds) == 0 {
+		return d.Exchange, d.RoutingKey
+	}
+	first := ds[len(ds)-1]
+	key := ""
+	if len(first.RoutingKeys) > 0 {
+		key = first.RoutingKeys[0]
+	}
+	return first.Exchange, key
+}
+
+// filter selects the messages replayed: those dead-lettered for the given
+// reason, if set, whose JSON body has every field in where.
+type filter struct {
+	reason string
+	where  map[string]string
+}
+
+func (f filter) match(d streadway.Delivery) bool {
+	if f.reason != "" {
+		ds := deaths(d.Headers)
+		if len(ds) == 0 || ds[0].Reason != f.reason {
+			return false
+		}
+	}
+
+	if len(f.where) == 0 {
+		return true
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(d.Body, &fields); err != nil {
+		return false
+	}
+	for name, value := range f.where {
+		if s, ok := fields[name].(string); !ok || s != value {
+			return false
+		}
+	}
+	return true
+}
+
+// replayLimit returns how many messages replay takes from a queue which held
+// depth messages when it started, at most max if max is above zero.
+// Messages republished where no queue is bound are dead-lettered straight
+// back onto the queue, and are left there rather than replayed for ever.
+func replayLimit(max int, depth int) int {
+	if max > 0 && max < depth {
+		return max
+	}
+	return depth
+}
+
+// republishing returns the message to publish when replaying a delivery,
+// without the headers recording its dead-lettering.
+func republishing(d streadway.Delivery) streadway.Publishing {
+	headers := streadway.Table{}
+	for name, value := range d.Headers {
+		if !deathHeader(name) {
+			headers[name] = value
+		}
+	}
+	return streadway.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
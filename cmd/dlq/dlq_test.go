@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	streadway "github.com/streadway/amqp"
+)
+
+// deadLettered is an event which expired on a replica queue, then was
+// rejected from the DLQ
+func deadLettered() streadway.Delivery {
+	now := time.Unix(1500000000, 0).UTC()
+	return streadway.Delivery{
+		Exchange:   "analytics-test-dlx",
+		RoutingKey: "",
+		Headers: streadway.Table{
+			"timestamp_in_ns":      "1500000000000000000",
+			"x-first-death-reason": "expired",
+			"x-death": []interface{}{
+				streadway.Table{
+					"count": int64(1), "reason": "rejected", "queue": "analytics-test-dlq",
+					"exchange": "analytics-test-dlx", "routing-keys": []interface{}{""}, "time": now,
+				},
+				streadway.Table{
+					"count": int64(2), "reason": "expired", "queue": "host1",
+					"exchange": "events", "routing-keys": []interface{}{"dns_message"}, "time": now,
+				},
+			},
+		},
+		Body: []byte(`{"action":"dns_message","device":"dev1"}`),
+	}
+}
+
+func TestRecord(t *testing.T) {
+	r := newRecord("analytics-test-dlq", deadLettered())
+	if len(r.Deaths) != 2 || r.Deaths[1].Count != 2 || r.Deaths[1].RoutingKeys[0] != "dns_message" {
+		t.Errorf("got deaths %+v", r.Deaths)
+	}
+	if _, ok := r.Headers["x-death"]; ok {
+		t.Error("x-death is repeated in the headers")
+	}
+	if _, err := json.Marshal(r); err != nil {
+		t.Fatal(err)
+	}
+
+	binary := newRecord("q", streadway.Delivery{Body: []byte{0xff, 0xfe}})
+	if binary.Body != "" || len(binary.BodyBase64) != 2 {
+		t.Errorf("binary body recorded as %q / %v", binary.Body, binary.BodyBase64)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	exch, key := origin(deadLettered())
+	if exch != "events" || key != "dns_message" {
+		t.Errorf("got origin %s/%s, expected events/dns_message", exch, key)
+	}
+
+	// Unroutable messages arrive without x-death
+	exch, key = origin(streadway.Delivery{Exchange: "events", RoutingKey: "http_request"})
+	if exch != "events" || key != "http_request" {
+		t.Errorf("got origin %s/%s, expected events/http_request", exch, key)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	d := deadLettered()
+	for _, test := range []struct {
+		f     filter
+		match bool
+	}{
+		{filter{}, true},
+		{filter{reason: "rejected"}, true},
+		{filter{reason: "expired"}, false},
+		{filter{where: map[string]string{"action": "dns_message"}}, true},
+		{filter{where: map[string]string{"action": "dns_message", "device": "dev2"}}, false},
+	} {
+		if got := test.f.match(d); got != test.match {
+			t.Errorf("%+v: got %v, expected %v", test.f, got, test.match)
+		}
+	}
+}
+
+func TestRepublishing(t *testing.T) {
+	p := republishing(deadLettered())
+	if len(p.Headers) != 1 || p.Headers["timestamp_in_ns"] == nil {
+		t.Errorf("got headers %v, expected only timestamp_in_ns", p.Headers)
+	}
+}
+
+func TestReplayLimit(t *testing.T) {
+	for _, test := range []struct {
+		max, depth, limit int
+	}{
+		{0, 10, 10},
+		{5, 10, 5},
+		{20, 10, 10},
+		{0, 0, 0},
+	} {
+		if got := replayLimit(test.max, test.depth); got != test.limit {
+			t.Errorf("max %d, depth %d: got %d, expected %d", test.max, test.depth, got, test.limit)
+		}
+	}
+}
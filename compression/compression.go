@@ -0,0 +1,192 @@
+// The compression package compresses message bodies for the wire, naming
+// each codec by the content encoding carried in the message envelope.
+
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec compresses and decompresses whole message bodies.
+type Codec interface {
+	// Content encoding of compressed bodies
+	Name() string
+	Encode(body []byte) ([]byte, error)
+	Decode(body []byte) ([]byte, error)
+}
+
+// Largest body a codec decompresses to. Bodies which would decompress to
+// more, as a small message crafted to expand enormously can, fail with
+// ErrTooLarge rather than exhausting memory.
+var MaxDecodedSize = 64 << 20
+
+// ErrTooLarge is returned for bodies which decompress to more than
+// MaxDecodedSize bytes.
+var ErrTooLarge = errors.New("decompressed body exceeds the maximum size")
+
+var codecs = map[string]Codec{
+	"gzip":   gzipCodec{},
+	"zstd":   &zstdCodec{},
+	"snappy": snappyCodec{},
+}
+
+// Lookup returns the codec for a content encoding: gzip, zstd or snappy.
+func Lookup(encoding string) (Codec, error) {
+	c, ok := codecs[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unknown content encoding %q", encoding)
+	}
+	return c, nil
+}
+
+// Decode decompresses a body with the codec for its content encoding. Bodies
+// without a content encoding are returned as they are.
+func Decode(encoding string, body []byte) ([]byte, error) {
+	if encoding == "" || encoding == "identity" {
+		return body, nil
+	}
+	c, err := Lookup(encoding)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decode(body)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) Encode(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(body []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	decoded, err := ioutil.ReadAll(io.LimitReader(r, int64(MaxDecodedSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > MaxDecodedSize {
+		return nil, ErrTooLarge
+	}
+	return decoded, nil
+}
+
+// The zstd encoder and decoder are safe for concurrent use, and costly to
+// create, so are shared.
+type zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (*zstdCodec) Name() string {
+	return "zstd"
+}
+
+func (z *zstdCodec) init() error {
+	z.once.Do(func() {
+		z.encoder, z.err = zstd.NewWriter(nil)
+		if z.err == nil {
+			z.decoder, z.err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(MaxDecodedSize)))
+		}
+	})
+	return z.err
+}
+
+func (z *zstdCodec) Encode(body []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.encoder.EncodeAll(body, nil), nil
+}
+
+func (z *zstdCodec) Decode(body []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	decoded, err := z.decoder.DecodeAll(body, nil)
+	if err == zstd.ErrDecoderSizeExceeded || len(decoded) > MaxDecodedSize {
+		return nil, ErrTooLarge
+	}
+	return decoded, err
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string {
+	return "snappy"
+}
+
+func (snappyCodec) Encode(body []byte) ([]byte, error) {
+	return snappy.Encode(nil, body), nil
+}
+
+func (snappyCodec) Decode(body []byte) ([]byte, error) {
+	// The decoded length comes first, so is checked before decoding
+	n, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxDecodedSize {
+		return nil, ErrTooLarge
+	}
+	return snappy.Decode(nil, body)
+}
+
+// Compressor compresses bodies of Threshold bytes or more with Codec.
+type Compressor struct {
+	Codec     Codec
+	Threshold int
+}
+
+// Return a compressor for a content encoding, compressing bodies of at
+// least threshold bytes.
+func NewCompressor(encoding string, threshold int) (*Compressor, error) {
+	c, err := Lookup(encoding)
+	if err != nil {
+		return nil, err
+	}
+	return &Compressor{Codec: c, Threshold: threshold}, nil
+}
+
+// Compress returns the body to send and its content encoding. The body is
+// left as it is, with no encoding, if it is below the threshold or would
+// not get any smaller.
+func (c *Compressor) Compress(body []byte) ([]byte, string, error) {
+	if len(body) < c.Threshold {
+		return body, "", nil
+	}
+	compressed, err := c.Codec.Encode(body)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(compressed) >= len(body) {
+		return body, "", nil
+	}
+	return compressed, c.Codec.Name(), nil
+}
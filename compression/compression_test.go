@@ -0,0 +1,71 @@
+package compression
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	body := []byte(strings.Repeat(`{"action":"http_response","body":"aGVsbG8="}`, 100))
+
+	for _, encoding := range []string{"gzip", "zstd", "snappy"} {
+		c, err := NewCompressor(encoding, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compressed, got, err := c.Compress(body)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if got != encoding || len(compressed) >= len(body) {
+			t.Errorf("%s: compressed %d bytes to %d, encoded %q", encoding, len(body), len(compressed), got)
+		}
+
+		decoded, err := Decode(got, compressed)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if !bytes.Equal(decoded, body) {
+			t.Errorf("%s: body changed in the round trip", encoding)
+		}
+
+		if _, got, _ := c.Compress(body[:100]); got != "" {
+			t.Errorf("%s: body below the threshold encoded %q", encoding, got)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	if got, err := Decode("", []byte("plain")); err != nil || string(got) != "plain" {
+		t.Errorf("got %q, %v decoding a body without an encoding", got, err)
+	}
+	if _, err := Decode("brotli", []byte("x")); err == nil {
+		t.Error("decoded an unknown encoding without error")
+	}
+	if _, err := Decode("gzip", []byte("not gzip")); err == nil {
+		t.Error("decoded a corrupt body without error")
+	}
+}
+
+func TestMaxDecodedSize(t *testing.T) {
+	defer func(max int) { MaxDecodedSize = max }(MaxDecodedSize)
+	MaxDecodedSize = 1000
+
+	for _, encoding := range []string{"gzip", "zstd", "snappy"} {
+		c, err := Lookup(encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for size, expected := range map[int]error{1000: nil, 1001: ErrTooLarge} {
+			compressed, err := c.Encode(make([]byte, size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Decode(encoding, compressed); err != expected {
+				t.Errorf("%s: got %v decoding %d bytes, expected %v", encoding, err, size, expected)
+			}
+		}
+	}
+}
@@ -134,6 +134,9 @@ type Operation struct {
 	Values map[string]string `json:"values"`
 }
 
+// Version of the Event schema, given as the SchemaVersion of published events
+const EventSchemaVersion = "1"
+
 // Network event
 type Event struct {
 	Id      string `json:"id,omitempty"`
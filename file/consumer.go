@@ -0,0 +1,165 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Consumer reads messages, one per line, from a file, a directory of files
+// or standard input.
+type Consumer struct {
+	Path string
+
+	transport *Transport
+}
+
+// Return a consumer of the file or directory at the input's path, or of
+// standard input if it is Stdio. The name is unused, as every consumer reads
+// its input in full.
+func (t *Transport) NewConsumer(ctx context.Context, name string, input string) broker.Consumer {
+	return &Consumer{Path: input, transport: t}
+}
+
+// Consume passes each line of the input to handle, returning once the input
+// is exhausted or ctx is done. Blank lines are skipped.
+func (c *Consumer) Consume(ctx context.Context, handle func(broker.Delivery)) error {
+	if c.Path == Stdio {
+		utils.Log("file: reading events from: stdin")
+		return read(ctx, "stdin", c.transport.Stdin, handle)
+	}
+
+	paths, err := inputFiles(c.Path)
+	if err != nil {
+		return err
+	}
+	utils.Log("file: reading events from: %s", c.Path)
+
+	for _, path := range paths {
+		if err := readFile(ctx, path, handle); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+	utils.Log("file: finished reading %s", c.Path)
+	return nil
+}
+
+// inputFiles returns the files to read for an input path: the file itself,
+// or the files in a directory in name order, skipping hidden files and
+// subdirectories.
+func inputFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("file: cannot read %s: %v", path, err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("file: cannot read %s: %v", path, err)
+	}
+	var paths []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		paths = append(paths, filepath.Join(path, e.Name()))
+	}
+	return paths, nil
+}
+
+func readFile(ctx context.Context, path string, handle func(broker.Delivery)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("file: cannot read %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("file: cannot decompress %s: %v", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return read(ctx, path, r, handle)
+}
+
+// read passes each line read from r to handle. Lines may be of any length.
+func read(ctx context.Context, source string, r io.Reader, handle func(broker.Delivery)) error {
+	br := bufio.NewReader(r)
+	for n := 1; ctx.Err() == nil; n++ {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			body := bytes.TrimRight(line, "\r\n")
+			handle(&delivery{body: body, ts: time.Now(), source: source, line: n})
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("file: cannot read %s: %v", source, err)
+		}
+	}
+	return nil
+}
+
+// delivery is a line read from an input. There is nothing to settle, as a
+// file cannot be read again in part, so deliveries which are not acked are
+// only logged.
+type delivery struct {
+	body []byte
+	// When the line was read
+	ts time.Time
+
+	source string
+	line   int
+}
+
+func (d *delivery) Body() []byte {
+	return d.body
+}
+
+func (d *delivery) Timestamp() time.Time {
+	return d.ts
+}
+
+func (d *delivery) Envelope() broker.Envelope {
+	return broker.Envelope{}
+}
+
+func (d *delivery) Key() string {
+	return ""
+}
+
+func (d *delivery) Ack() error {
+	return nil
+}
+
+func (d *delivery) Nack() error {
+	utils.Log("file: message at %s:%d was not handled, and cannot be delivered again", d.source, d.line)
+	return nil
+}
+
+func (d *delivery) Reject() error {
+	utils.Log("file: rejected message at %s:%d", d.source, d.line)
+	return nil
+}
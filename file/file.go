@@ -0,0 +1,167 @@
+// The file package implements broker.Transport on newline delimited files,
+// so that an analytic can be run as a batch tool over captured events, or
+// debugged, without a broker.
+//
+// A consumer reads each line of its input as a message: a file, every file
+// in a directory in name order, or standard input if the input is "-".
+// Files ending ".gz" are decompressed as they are read. Consume returns once
+// the input is exhausted. A publisher appends each message to the file its
+// endpoint names, or writes it to standard output if the endpoint is "-", as
+// a line of JSON.
+
+package file
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+var (
+	_ broker.Transport = (*Transport)(nil)
+	_ broker.Publisher = (*Publisher)(nil)
+	_ broker.Consumer  = (*Consumer)(nil)
+)
+
+func init() {
+	broker.RegisterOutputBackend("file", outputBackend)
+	broker.RegisterOutputBackend("stdout", stdoutBackend)
+	broker.RegisterInputBackend("file", inputBackend)
+	broker.RegisterInputBackend("stdin", stdinBackend)
+}
+
+// Stdio is the path of standard input for consumers, and of standard
+// output for publishers.
+const Stdio = "-"
+
+// Transport reads inputs from and writes outputs to files. Publishers to
+// the same file share it, so that their lines are never interleaved.
+type Transport struct {
+	// Standard input and output, which may be replaced for testing
+	Stdin  io.Reader
+	Stdout io.Writer
+
+	mu    sync.Mutex
+	sinks map[string]*sink
+}
+
+// Return a transport reading and writing files.
+func NewTransport() *Transport {
+	return &Transport{Stdin: os.Stdin, Stdout: os.Stdout, sinks: make(map[string]*sink)}
+}
+
+func (t *Transport) Name() string {
+	return "file"
+}
+
+// sink is a file written by one or more publishers.
+type sink struct {
+	mu   sync.Mutex
+	w    io.Writer
+	refs int
+}
+
+// open returns the sink for a path, opening the file for appending if no
+// publisher has it open already.
+func (t *Transport) open(path string) (*sink, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s, ok := t.sinks[path]; ok {
+		s.refs++
+		return s, nil
+	}
+
+	w := t.Stdout
+	if path != Stdio {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	s := &sink{w: w, refs: 1}
+	t.sinks[path] = s
+	return s, nil
+}
+
+// release closes the file once the last publisher to it is finished.
+// Standard output is left open.
+func (t *Transport) release(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.sinks[path]
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(t.sinks, path)
+	if f, ok := s.w.(io.Closer); ok && path != Stdio {
+		return f.Close()
+	}
+	return nil
+}
+
+// write writes whole lines, so that lines from publishers sharing the sink
+// are never interleaved.
+func (s *sink) write(lines []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(lines)
+	return err
+}
+
+// The transport behind worker inputs and outputs, shared so that outputs
+// writing the same file never interleave their lines
+var std = NewTransport()
+
+// filePath returns the path named by a file URL, "file:///path",
+// "file:/path" or "file:relative/path".
+func filePath(u *url.URL) (string, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("file URL %s names host %q, expected file:///path", u.String(), u.Host)
+	}
+	path := u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return "", fmt.Errorf("no path given in %s", u.String())
+	}
+	return path, nil
+}
+
+// outputBackend appends each message sent to an output "file:///path" to
+// the file as a line of JSON.
+func outputBackend(u *url.URL, _ broker.Transport) (broker.Transport, string, error) {
+	path, err := filePath(u)
+	return std, path, err
+}
+
+// stdoutBackend writes each message sent to an output "stdout:" to
+// standard output as a line of JSON.
+func stdoutBackend(u *url.URL, _ broker.Transport) (broker.Transport, string, error) {
+	if u.Opaque != "" || u.Host != "" || u.Path != "" {
+		return nil, "", fmt.Errorf("%s names a path, expected stdout:", u.String())
+	}
+	return std, Stdio, nil
+}
+
+// inputBackend reads an input "file:/path", a file or directory of files.
+func inputBackend(u *url.URL) (broker.Transport, string, error) {
+	path, err := filePath(u)
+	return std, path, err
+}
+
+// stdinBackend reads an input "stdin:" from standard input.
+func stdinBackend(u *url.URL) (broker.Transport, string, error) {
+	if u.Opaque != "" || u.Host != "" || u.Path != "" {
+		return nil, "", fmt.Errorf("%s names a path, expected stdin:", u.String())
+	}
+	return std, Stdio, nil
+}
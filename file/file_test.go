@@ -0,0 +1,139 @@
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/compression"
+)
+
+func consumeAll(t *testing.T, tr *Transport, input string) []string {
+	var bodies []string
+	err := tr.NewConsumer(context.Background(), "analytics-test", input).Consume(context.Background(),
+		func(d broker.Delivery) {
+			if d.Timestamp().IsZero() {
+				t.Error("delivery has no timestamp")
+			}
+			bodies = append(bodies, string(d.Body()))
+			d.Ack()
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bodies
+}
+
+func publish(t *testing.T, tr *Transport, endpoint string, msgs ...broker.Message) {
+	ch := make(chan broker.Message, len(msgs))
+	for _, msg := range msgs {
+		ch <- msg
+	}
+	close(ch)
+	if err := tr.NewPublisher(context.Background(), endpoint).Publish(ch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumeDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("{\"seq\":3}\n"))
+	zw.Close()
+
+	for name, content := range map[string][]byte{
+		"01.jsonl":    []byte("{\"seq\":1}\r\n\n  \n{\"seq\":2}"),
+		"02.jsonl.gz": gz.Bytes(),
+		".hidden":     []byte("{\"seq\":0}\n"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Join(consumeAll(t, NewTransport(), dir), " ")
+	if expected := `{"seq":1} {"seq":2} {"seq":3}`; got != expected {
+		t.Errorf("got %s, expected %s", got, expected)
+	}
+
+	got = strings.Join(consumeAll(t, NewTransport(), filepath.Join(dir, "01.jsonl")), " ")
+	if expected := `{"seq":1} {"seq":2}`; got != expected {
+		t.Errorf("got %s, expected %s", got, expected)
+	}
+
+	err = NewTransport().NewConsumer(context.Background(), "analytics-test", filepath.Join(dir, "missing")).
+		Consume(context.Background(), func(broker.Delivery) {})
+	if err == nil {
+		t.Error("consumed a missing file")
+	}
+}
+
+func TestStdio(t *testing.T) {
+	var out bytes.Buffer
+	tr := NewTransport()
+	tr.Stdin = strings.NewReader("a\nb\n")
+	tr.Stdout = &out
+
+	if got := strings.Join(consumeAll(t, tr, Stdio), " "); got != "a b" {
+		t.Errorf("got %q from stdin", got)
+	}
+
+	publish(t, tr, Stdio, broker.Message{Body: []byte("{ \"a\": 1 }")})
+	if out.String() != "{\"a\":1}\n" {
+		t.Errorf("got %q on stdout", out.String())
+	}
+}
+
+func TestPublishJSONLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.jsonl")
+
+	gz, err := compression.NewCompressor("gzip", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, encoding, err := gz.Compress([]byte(`{"b": [1, 2]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := NewTransport()
+	publish(t, tr, path,
+		broker.Message{Body: []byte("{\n  \"a\": 1\n}")},
+		broker.Message{Body: compressed, Envelope: broker.Envelope{ContentEncoding: encoding}},
+		broker.Message{Body: []byte("not \"json\"")},
+	)
+	// Files are appended to, never truncated
+	publish(t, tr, path, broker.Message{Body: []byte("{}")})
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "{\"a\":1}\n{\"b\":[1,2]}\n\"not \\\"json\\\"\"\n{}\n"
+	if string(content) != expected {
+		t.Errorf("got %q, expected %q", content, expected)
+	}
+	if len(tr.sinks) != 0 {
+		t.Errorf("%d files left open", len(tr.sinks))
+	}
+}
@@ -0,0 +1,111 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/compression"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Lines are written once this many bytes are buffered, or when no more
+// messages are waiting
+const flushSize = 64 * 1024
+
+// Publisher writes messages to a file as JSON lines.
+type Publisher struct {
+	Path string
+
+	transport *Transport
+	ctx       context.Context
+}
+
+// Return a publisher appending to the file at the endpoint's path, or
+// writing to standard output if it is Stdio.
+func (t *Transport) NewPublisher(ctx context.Context, endpoint string) broker.Publisher {
+	return &Publisher{Path: endpoint, transport: t, ctx: ctx}
+}
+
+// line returns a message as a line of JSON. JSON bodies, such as events,
+// are written compacted onto one line, and any other body as a JSON string.
+// Compressed bodies are decompressed first.
+func line(msg broker.Message) ([]byte, error) {
+	body := msg.Body
+	if msg.ContentEncoding != "" {
+		var err error
+		body, err = compression.Decode(msg.ContentEncoding, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	if json.Valid(body) {
+		if err := json.Compact(&buf, body); err != nil {
+			return nil, err
+		}
+	} else {
+		s, err := json.Marshal(string(body))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(s)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// Publish writes messages until the channel is closed, returning once
+// everything read from it has been written, or with an error if the
+// publisher's context is done first or the file cannot be written.
+func (p *Publisher) Publish(messages <-chan broker.Message) error {
+	s, err := p.transport.open(p.Path)
+	if err != nil {
+		return fmt.Errorf("file: cannot open %s: %v", p.Path, err)
+	}
+	defer func() {
+		if err := p.transport.release(p.Path); err != nil {
+			utils.Log("file: cannot close %s: %s", p.Path, err.Error())
+		}
+	}()
+
+	utils.Log("file: writing events to: %s", p.Path)
+
+	var buf bytes.Buffer
+	for {
+		select {
+		case msg, open := <-messages:
+			if !open {
+				return p.flush(s, &buf)
+			}
+			l, err := line(msg)
+			if err != nil {
+				utils.Log("file: dropping message which cannot be written to %s: %s", p.Path, err.Error())
+				continue
+			}
+			buf.Write(l)
+			if buf.Len() >= flushSize || len(messages) == 0 {
+				if err := p.flush(s, &buf); err != nil {
+					return err
+				}
+			}
+
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+	}
+}
+
+func (p *Publisher) flush(s *sink, buf *bytes.Buffer) error {
+	if buf.Len() == 0 {
+		return nil
+	}
+	if err := s.write(buf.Bytes()); err != nil {
+		return fmt.Errorf("file: cannot write to %s: %v", p.Path, err)
+	}
+	buf.Reset()
+	return nil
+}
@@ -0,0 +1,353 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Consumer reads a topic as a member of a consumer group. Each message's
+// offset is committed once it, and every message before it in its
+// partition, has been settled, so nothing is committed before its handler
+// has finished with it. Commits are made in the background, as settling
+// moves the head of a partition on and every CommitInterval, and once more
+// as the consumer closes. Nacked messages are delivered again.
+//
+// When the group rebalances, the reader reads every partition it keeps again
+// from its committed offset. Seeing a partition go back marks a new
+// generation: what was fetched before is no longer committed, whether its
+// partition was kept or has gone to another member, and settling it does
+// nothing.
+type Consumer struct {
+	Topic string
+	Group string
+	// Topic receiving rejected messages
+	DeadLetterTopic string
+
+	transport *Transport
+	// Bounds the lifetime of the reader, which outlives Consume so that
+	// deliveries can still be settled
+	ctx context.Context
+	err error
+
+	mu         sync.Mutex
+	reader     Reader
+	partitions map[int]*partition
+	generation int
+	dlq        Writer
+	// Nacked messages to deliver again, and a signal that there are some
+	nacked  []kafkago.Message
+	requeue chan struct{}
+	// Signals that a partition has messages to commit
+	settled chan struct{}
+}
+
+// Messages fetched from a partition and not yet committed, in offset
+// order, and which of them have been settled
+type partition struct {
+	pending []kafkago.Message
+	settled map[int64]bool
+	// Offset of the latest message fetched
+	fetched int64
+	// The last of the settled messages at the head, to be committed
+	commit *kafkago.Message
+}
+
+// How often settled messages are committed, if settling has not done so
+const CommitInterval = time.Second
+
+// Time allowed for the last commit as the consumer closes
+const closeCommitTimeout = 5 * time.Second
+
+// Return a consumer of the topic named by input in the consumer group name,
+// dead-lettering rejected messages to "<name>-dlq". Kafka cannot filter
+// messages by key, so inputs must not have a filter, as in "topic/keys".
+func (t *Transport) NewConsumer(ctx context.Context, name string, input string) broker.Consumer {
+	topic, filter, _ := broker.SplitEndpoint(input)
+
+	c := &Consumer{
+		Topic:           topic,
+		Group:           name,
+		DeadLetterTopic: fmt.Sprintf("%s-dlq", name),
+		transport:       t,
+		ctx:             ctx,
+		partitions:      make(map[int]*partition),
+		requeue:         make(chan struct{}, 1),
+		settled:         make(chan struct{}, 1),
+	}
+	if filter != "" && filter != "#" {
+		c.err = fmt.Errorf("kafka: cannot filter %s by key %q", topic, filter)
+		return c
+	}
+	c.reader = t.Client.NewReader(topic, name)
+	go c.commitLoop()
+
+	return c
+}
+
+// commitLoop commits settled messages until the consumer's context is done,
+// then commits what remains and closes the reader.
+func (c *Consumer) commitLoop() {
+	ticker := time.NewTicker(CommitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.settled:
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), closeCommitTimeout)
+			if err := c.commit(ctx); err != nil {
+				utils.Log("error: %s", err.Error())
+			}
+			cancel()
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.reader.Close()
+			if c.dlq != nil {
+				c.dlq.Close()
+			}
+			return
+		}
+		if err := c.commit(c.ctx); err != nil && c.ctx.Err() == nil {
+			utils.Log("error: %s", err.Error())
+		}
+	}
+}
+
+// commit commits the offsets settled since the last commit. Those which
+// fail are tried again next time, unless newer ones have been settled.
+func (c *Consumer) commit(ctx context.Context) error {
+	c.mu.Lock()
+	var msgs []kafkago.Message
+	for _, p := range c.partitions {
+		if p.commit != nil {
+			msgs = append(msgs, *p.commit)
+			p.commit = nil
+		}
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	if len(msgs) == 0 {
+		return nil
+	}
+	err := c.reader.CommitMessages(ctx, msgs...)
+	if err == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		for i := range msgs {
+			if p := c.partitions[msgs[i].Partition]; p != nil && p.commit == nil {
+				p.commit = &msgs[i]
+			}
+		}
+	}
+	return fmt.Errorf("kafka: cannot commit offsets of %s: %v", c.Topic, err)
+}
+
+// Consume passes messages to handle until ctx is done. Nacked messages are
+// passed to it again before any more are fetched.
+func (c *Consumer) Consume(ctx context.Context, handle func(broker.Delivery)) error {
+	if c.err != nil {
+		return c.err
+	}
+
+	fetched := make(chan kafkago.Message)
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := c.reader.FetchMessage(ctx)
+			if err != nil {
+				failed <- err
+				return
+			}
+			select {
+			case fetched <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	utils.Log("kafka: subscribed to events from: %s", c.Topic)
+	for {
+		c.mu.Lock()
+		if len(c.nacked) > 0 {
+			msg := c.nacked[0]
+			c.nacked = c.nacked[1:]
+			generation := c.generation
+			c.mu.Unlock()
+			// Still pending in its partition, it is settled afresh
+			handle(&delivery{msg: msg, env: envelope(msg), consumer: c, generation: generation})
+			continue
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.requeue:
+
+		case msg := <-fetched:
+			c.mu.Lock()
+			p, ok := c.partitions[msg.Partition]
+			if ok && msg.Offset <= p.fetched {
+				c.rebalanced()
+				ok = false
+			}
+			if !ok {
+				p = &partition{settled: make(map[int64]bool)}
+				c.partitions[msg.Partition] = p
+			}
+			p.fetched = msg.Offset
+			p.pending = append(p.pending, msg)
+			generation := c.generation
+			c.mu.Unlock()
+
+			handle(&delivery{msg: msg, env: envelope(msg), consumer: c, generation: generation})
+
+		case err := <-failed:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("kafka: cannot fetch from %s: %v", c.Topic, err)
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// rebalanced starts a new generation once the group has rebalanced, dropping
+// everything fetched before.
+func (c *Consumer) rebalanced() {
+	c.generation++
+	c.partitions = make(map[int]*partition)
+	c.nacked = nil
+	utils.Log("kafka: consumer group %s rebalanced, reading %s from its committed offsets", c.Group, c.Topic)
+}
+
+// settle marks a message as settled, leaving the last of the settled
+// messages at the head of its partition to be committed.
+func (c *Consumer) settle(msg kafkago.Message, generation int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+
+	p := c.partitions[msg.Partition]
+	p.settled[msg.Offset] = true
+
+	moved := false
+	for len(p.pending) > 0 && p.settled[p.pending[0].Offset] {
+		head := p.pending[0]
+		p.commit = &head
+		delete(p.settled, head.Offset)
+		p.pending = p.pending[1:]
+		moved = true
+	}
+	if moved {
+		select {
+		case c.settled <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// redeliver queues a nacked message to be delivered again. Its offset is left
+// pending, holding back the commits of those after it until it is settled.
+func (c *Consumer) redeliver(msg kafkago.Message, generation int) {
+	c.mu.Lock()
+	if generation != c.generation {
+		c.mu.Unlock()
+		return
+	}
+	c.nacked = append(c.nacked, msg)
+	c.mu.Unlock()
+
+	select {
+	case c.requeue <- struct{}{}:
+	default:
+	}
+}
+
+// deadLetter writes a message to the dead letter topic.
+func (c *Consumer) deadLetter(msg kafkago.Message) error {
+	c.mu.Lock()
+	if c.dlq == nil {
+		c.dlq = c.transport.Client.NewWriter(c.DeadLetterTopic)
+	}
+	dlq := c.dlq
+	c.mu.Unlock()
+
+	return dlq.WriteMessages(c.ctx, kafkago.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: msg.Headers,
+		Time:    msg.Time,
+	})
+}
+
+type delivery struct {
+	msg        kafkago.Message
+	env        broker.Envelope
+	consumer   *Consumer
+	generation int
+	once       sync.Once
+}
+
+func (d *delivery) Body() []byte {
+	return d.msg.Value
+}
+
+func (d *delivery) Timestamp() time.Time {
+	return d.msg.Time
+}
+
+func (d *delivery) Envelope() broker.Envelope {
+	return d.env
+}
+
+func (d *delivery) Key() string {
+	return string(d.msg.Key)
+}
+
+// Ack leaves the message to be committed once those before it are settled.
+func (d *delivery) Ack() error {
+	d.once.Do(func() {
+		d.consumer.settle(d.msg, d.generation)
+	})
+	return nil
+}
+
+// Nack delivers the message again, as Kafka cannot return one message to
+// its topic. It stays uncommitted meanwhile, so if the consumer stops first
+// it is read again once the group next rebalances or restarts.
+func (d *delivery) Nack() error {
+	d.once.Do(func() {
+		d.consumer.redeliver(d.msg, d.generation)
+	})
+	return nil
+}
+
+// Reject writes the message to the dead letter topic, and settles it.
+func (d *delivery) Reject() error {
+	var err error
+	d.once.Do(func() {
+		if err = d.consumer.deadLetter(d.msg); err != nil {
+			err = fmt.Errorf("kafka: cannot dead-letter message from %s: %v", d.consumer.Topic, err)
+			return
+		}
+		d.consumer.settle(d.msg, d.generation)
+	})
+	return err
+}
@@ -0,0 +1,37 @@
+package kafka
+
+import (
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+// message returns the Kafka message for a message published now.
+func message(msg broker.Message, now time.Time) kafkago.Message {
+	out := kafkago.Message{
+		Value: msg.Body,
+		Time:  now,
+	}
+	if msg.Key != "" {
+		out.Key = []byte(msg.Key)
+	}
+	// Kafka has no message properties, so the whole envelope travels in
+	// headers
+	msg.SetHeaders(func(name string, value string) {
+		out.Headers = append(out.Headers, kafkago.Header{Key: name, Value: []byte(value)})
+	})
+	return out
+}
+
+// envelope reads the envelope of a received message.
+func envelope(msg kafkago.Message) broker.Envelope {
+	return broker.EnvelopeFromHeaders(func(name string) string {
+		for _, header := range msg.Headers {
+			if header.Key == name {
+				return string(header.Value)
+			}
+		}
+		return ""
+	})
+}
@@ -0,0 +1,152 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+// Fake is an in-memory stand-in for a Kafka cluster, so that transports can
+// be exercised in tests without one. Each topic has a single partition, and
+// each consumer group reads it from its last committed offset.
+type Fake struct {
+	mu     sync.Mutex
+	topics map[string][]kafkago.Message
+	// Committed offsets by topic and then group
+	committed map[string]map[string]int64
+	readers   []*fakeReader
+	// Closed and replaced whenever a message is written
+	written chan struct{}
+}
+
+// Return an empty fake cluster.
+func NewFake() *Fake {
+	return &Fake{
+		topics:    make(map[string][]kafkago.Message),
+		committed: make(map[string]map[string]int64),
+		written:   make(chan struct{}),
+	}
+}
+
+// Messages returns the messages written to a topic.
+func (f *Fake) Messages(topic string) []kafkago.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]kafkago.Message(nil), f.topics[topic]...)
+}
+
+// Committed returns the offset a consumer group has committed on a topic:
+// that of the next message it would read.
+func (f *Fake) Committed(topic string, group string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.committed[topic][group]
+}
+
+// Rebalance has a consumer group's readers of a topic read it again from
+// the group's committed offset, as they do once the group rebalances.
+func (f *Fake) Rebalance(topic string, group string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.readers {
+		if r.topic == topic && r.group == group {
+			r.offset = f.committed[topic][group]
+		}
+	}
+	close(f.written)
+	f.written = make(chan struct{})
+}
+
+func (f *Fake) NewWriter(topic string) Writer {
+	return &fakeWriter{fake: f, topic: topic}
+}
+
+func (f *Fake) NewReader(topic string, group string) Reader {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := &fakeReader{fake: f, topic: topic, group: group, offset: f.committed[topic][group]}
+	f.readers = append(f.readers, r)
+	return r
+}
+
+type fakeWriter struct {
+	fake  *Fake
+	topic string
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafkago.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f := w.fake
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, msg := range msgs {
+		msg.Topic = w.topic
+		msg.Offset = int64(len(f.topics[w.topic]))
+		f.topics[w.topic] = append(f.topics[w.topic], msg)
+	}
+	close(f.written)
+	f.written = make(chan struct{})
+	return nil
+}
+
+func (w *fakeWriter) Close() error {
+	return nil
+}
+
+type fakeReader struct {
+	fake  *Fake
+	topic string
+	group string
+	// Guarded by the fake's lock
+	offset int64
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafkago.Message, error) {
+	f := r.fake
+	for {
+		f.mu.Lock()
+		msgs := f.topics[r.topic]
+		written := f.written
+		if r.offset < int64(len(msgs)) {
+			msg := msgs[r.offset]
+			r.offset++
+			f.mu.Unlock()
+			return msg, nil
+		}
+		f.mu.Unlock()
+
+		select {
+		case <-written:
+		case <-ctx.Done():
+			return kafkago.Message{}, ctx.Err()
+		}
+	}
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafkago.Message) error {
+	f := r.fake
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.committed[r.topic] == nil {
+		f.committed[r.topic] = make(map[string]int64)
+	}
+	for _, msg := range msgs {
+		if msg.Topic != r.topic {
+			return errors.New("message is from another topic")
+		}
+		if msg.Offset+1 > f.committed[r.topic][r.group] {
+			f.committed[r.topic][r.group] = msg.Offset + 1
+		}
+	}
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	return nil
+}
@@ -0,0 +1,129 @@
+// The kafka package implements broker.Transport on Kafka, for the parts of
+// the estate which run it instead of RabbitMQ. Output endpoints and worker
+// inputs name topics, routing keys become message keys, and each group of
+// consumers sharing the work, analytics-<Pgm> for a worker, is a Kafka
+// consumer group. Offsets are committed only once messages are settled.
+
+package kafka
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+var (
+	_ broker.Transport = (*Transport)(nil)
+	_ broker.Publisher = (*Publisher)(nil)
+	_ broker.Consumer  = (*Consumer)(nil)
+)
+
+func init() {
+	broker.RegisterTransport("kafka", transportFromEnv)
+}
+
+// transportFromEnv returns a transport for KAFKA_BROKERS, a comma separated
+// list of broker addresses, or nil if it is not set.
+func transportFromEnv() broker.Transport {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		return nil
+	}
+	return NewTransport(strings.Split(brokers, ","))
+}
+
+// Writer writes messages to a topic, as *kafka.Writer does.
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafkago.Message) error
+	Close() error
+}
+
+// Reader fetches messages from a topic for a consumer group, and commits
+// their offsets, as *kafka.Reader does.
+type Reader interface {
+	FetchMessage(ctx context.Context) (kafkago.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafkago.Message) error
+	Close() error
+}
+
+// Client opens writers and readers. The transport uses a Kafka cluster, or
+// a Fake in tests.
+type Client interface {
+	NewWriter(topic string) Writer
+	NewReader(topic string, group string) Reader
+}
+
+// Transport creates publishers and consumers, all using the same cluster.
+type Transport struct {
+	Client Client
+
+	// Messages written to Kafka at once, and how long to wait for a batch
+	// to fill
+	BatchSize   int
+	BatchLinger time.Duration
+
+	// Delay before retrying a failed write, doubling up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// Default batching and retry delays
+const (
+	DefaultBatchSize     = 100
+	DefaultBatchLinger   = 10 * time.Millisecond
+	DefaultRetryDelay    = 100 * time.Millisecond
+	DefaultMaxRetryDelay = 30 * time.Second
+)
+
+// Return a transport for the comma separated list of broker addresses, as
+// given by KAFKA_BROKERS.
+func NewTransport(brokers []string) *Transport {
+	return NewClientTransport(&cluster{brokers: brokers})
+}
+
+// As NewTransport, but through the given client, such as a Fake.
+func NewClientTransport(c Client) *Transport {
+	return &Transport{
+		Client:        c,
+		BatchSize:     DefaultBatchSize,
+		BatchLinger:   DefaultBatchLinger,
+		RetryDelay:    DefaultRetryDelay,
+		MaxRetryDelay: DefaultMaxRetryDelay,
+	}
+}
+
+func (t *Transport) Name() string {
+	return "kafka"
+}
+
+// cluster is the client for a real Kafka cluster.
+type cluster struct {
+	brokers []string
+}
+
+// Messages with the same key go to the same partition, so those from each
+// device, say, stay in order. Topics are created as they are first written
+// to, where the cluster allows it.
+func (c *cluster) NewWriter(topic string) Writer {
+	return &kafkago.Writer{
+		Addr:         kafkago.TCP(c.brokers...),
+		Topic:        topic,
+		Balancer:     &kafkago.Hash{},
+		RequiredAcks: kafkago.RequireAll,
+		BatchTimeout: DefaultBatchLinger,
+	}
+}
+
+// Offsets are committed as messages are settled, rather than periodically,
+// so that none is committed before it has been handled.
+func (c *cluster) NewReader(topic string, group string) Reader {
+	return kafkago.NewReader(kafkago.ReaderConfig{
+		Brokers: c.brokers,
+		Topic:   topic,
+		GroupID: group,
+	})
+}
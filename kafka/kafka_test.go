@@ -0,0 +1,227 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+// publish writes messages through a publisher to the endpoint
+func publish(t *testing.T, tr *Transport, endpoint string, msgs ...broker.Message) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := make(chan broker.Message, len(msgs))
+	for _, msg := range msgs {
+		ch <- msg
+	}
+	close(ch)
+	if err := tr.NewPublisher(ctx, endpoint).Publish(ch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// consume starts consuming the topic, returning the deliveries
+func consume(ctx context.Context, tr *Transport, group string, topic string) <-chan broker.Delivery {
+	ch := make(chan broker.Delivery, 10)
+	c := tr.NewConsumer(ctx, group, topic)
+	go c.Consume(ctx, func(d broker.Delivery) { ch <- d })
+	return ch
+}
+
+func next(t *testing.T, ch <-chan broker.Delivery) broker.Delivery {
+	select {
+	case d := <-ch:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for delivery")
+		return nil
+	}
+}
+
+// committed waits for the group to commit the offset on the topic, as
+// commits are made in the background
+func committed(t *testing.T, f *Fake, topic string, group string, offset int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Committed(topic, group) != offset {
+		if time.Now().After(deadline) {
+			t.Fatalf("committed offset %d, expected %d", f.Committed(topic, group), offset)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// notCommitted checks the group has committed nothing past the offset, after
+// giving it time to
+func notCommitted(t *testing.T, f *Fake, topic string, group string, offset int64) {
+	t.Helper()
+	time.Sleep(20 * time.Millisecond)
+	if got := f.Committed(topic, group); got > offset {
+		t.Errorf("committed offset %d, expected no more than %d", got, offset)
+	}
+}
+
+func TestPublishConsume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := NewFake()
+	tr := NewClientTransport(f)
+
+	env := broker.Envelope{
+		ContentType:   "application/json",
+		SchemaVersion: "1",
+		MessageID:     "id-1",
+		CorrelationID: "id-0",
+		Origin:        "analytics-test",
+		TraceParent:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		IngestTime:    time.Unix(1500000000, 123456789),
+	}
+	publish(t, tr, "events/default",
+		broker.Message{Body: []byte("{}"), Envelope: env},
+		broker.Message{Body: []byte("keyed"), Key: "device-1"},
+	)
+
+	msgs := f.Messages("events")
+	if len(msgs) != 2 || string(msgs[0].Key) != "default" || string(msgs[1].Key) != "device-1" {
+		t.Fatalf("got %d messages, expected two keyed by the endpoint and then their own key", len(msgs))
+	}
+
+	deliveries := consume(ctx, tr, "analytics-test", "events")
+	d := next(t, deliveries)
+	if string(d.Body()) != "{}" || d.Timestamp().IsZero() {
+		t.Errorf("got %q published at %s", d.Body(), d.Timestamp())
+	}
+	got := d.Envelope()
+	if !got.IngestTime.Equal(env.IngestTime) {
+		t.Errorf("got ingest time %s, expected %s", got.IngestTime, env.IngestTime)
+	}
+	got.IngestTime = env.IngestTime
+	if got != env {
+		t.Errorf("got envelope %+v, expected %+v", got, env)
+	}
+}
+
+func TestCommitAfterSettling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := NewFake()
+	tr := NewClientTransport(f)
+	publish(t, tr, "events",
+		broker.Message{Body: []byte("a")},
+		broker.Message{Body: []byte("b")},
+		broker.Message{Body: []byte("c")},
+	)
+
+	deliveries := consume(ctx, tr, "analytics-test", "events")
+	a, b, c := next(t, deliveries), next(t, deliveries), next(t, deliveries)
+	notCommitted(t, f, "events", "analytics-test", 0)
+
+	// Settling out of order commits nothing until the earlier messages are
+	// settled too
+	if err := b.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	notCommitted(t, f, "events", "analytics-test", 0)
+	if err := a.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	committed(t, f, "events", "analytics-test", 2)
+
+	// Rejected messages go to the group's dead letter topic
+	if err := c.Reject(); err != nil {
+		t.Fatal(err)
+	}
+	committed(t, f, "events", "analytics-test", 3)
+	if dlq := f.Messages("analytics-test-dlq"); len(dlq) != 1 || string(dlq[0].Value) != "c" {
+		t.Errorf("got %d dead letters, expected the rejected message", len(dlq))
+	}
+
+	// Another member of the group starts from the committed offset
+	publish(t, tr, "events", broker.Message{Body: []byte("d")})
+	if d := next(t, consume(ctx, tr, "analytics-test", "events")); string(d.Body()) != "d" {
+		t.Errorf("got %q, expected the first uncommitted message", d.Body())
+	}
+}
+
+func TestNackRedelivers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := NewFake()
+	tr := NewClientTransport(f)
+	publish(t, tr, "events", broker.Message{Body: []byte("a")}, broker.Message{Body: []byte("b")})
+
+	deliveries := consume(ctx, tr, "analytics-test", "events")
+	a, b := next(t, deliveries), next(t, deliveries)
+	a.Nack()
+	b.Ack()
+	notCommitted(t, f, "events", "analytics-test", 0)
+
+	// The nacked message comes round again, and settling it commits both
+	again := next(t, deliveries)
+	if string(again.Body()) != "a" {
+		t.Fatalf("got %q, expected the nacked message again", again.Body())
+	}
+	if err := again.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	committed(t, f, "events", "analytics-test", 2)
+}
+
+func TestRebalance(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := NewFake()
+	tr := NewClientTransport(f)
+	publish(t, tr, "events",
+		broker.Message{Body: []byte("a")},
+		broker.Message{Body: []byte("b")},
+		broker.Message{Body: []byte("c")},
+	)
+
+	deliveries := consume(ctx, tr, "analytics-test", "events")
+	a, b, c := next(t, deliveries), next(t, deliveries), next(t, deliveries)
+	b.Ack()
+
+	// Another member handled the first message while the partition was
+	// away, and the group's readers start again from its commit
+	other := f.NewReader("events", "analytics-test")
+	msg, err := other.FetchMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.CommitMessages(ctx, msg)
+	f.Rebalance("events", "analytics-test")
+
+	b2, c2 := next(t, deliveries), next(t, deliveries)
+	if string(b2.Body()) != "b" || string(c2.Body()) != "c" {
+		t.Fatalf("got %q and %q, expected b and c again", b2.Body(), c2.Body())
+	}
+
+	// The messages fetched before neither hold back commits nor are
+	// committed themselves
+	b2.Ack()
+	c2.Ack()
+	committed(t, f, "events", "analytics-test", 3)
+	a.Ack()
+	c.Nack()
+	notCommitted(t, f, "events", "analytics-test", 3)
+	select {
+	case d := <-deliveries:
+		t.Errorf("got %q again, nacked before the rebalance", d.Body())
+	default:
+	}
+}
+
+func TestFilteredInput(t *testing.T) {
+	c := NewClientTransport(NewFake()).NewConsumer(context.Background(), "analytics-test", "events/dns_message")
+	if err := c.Consume(context.Background(), func(broker.Delivery) {}); err == nil {
+		t.Error("consumed a filtered input, which Kafka cannot filter")
+	}
+}
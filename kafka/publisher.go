@@ -0,0 +1,120 @@
+package kafka
+
+import (
+	"context"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Publisher writes messages to a topic.
+type Publisher struct {
+	Topic string
+	// Key for messages without one of their own
+	RoutingKey string
+
+	transport *Transport
+	ctx       context.Context
+}
+
+// Return a publisher to the topic named by an endpoint, "topic" or
+// "topic/key" to give messages a default key.
+func (t *Transport) NewPublisher(ctx context.Context, endpoint string) broker.Publisher {
+	topic, key, _ := broker.SplitEndpoint(endpoint)
+	return &Publisher{Topic: topic, RoutingKey: key, transport: t, ctx: ctx}
+}
+
+// Publish writes messages in batches of up to the transport's BatchSize.
+// Writes which fail are retried until they succeed, so every message is
+// delivered at least once. It returns nil once the channel is closed and
+// everything read from it has been written, or an error if the publisher's
+// context is done first.
+func (p *Publisher) Publish(messages <-chan broker.Message) error {
+	w := p.transport.Client.NewWriter(p.Topic)
+	defer w.Close()
+
+	utils.Log("kafka: publishing events to: %s", p.Topic)
+
+	for {
+		batch, open := p.next(messages)
+		if err := p.write(w, batch); err != nil {
+			return err
+		}
+		if !open {
+			return p.ctx.Err()
+		}
+	}
+}
+
+// next reads a batch of messages, waiting for the first and then up to the
+// transport's BatchLinger for the batch to fill. open is false once the
+// channel is closed or the context is done.
+func (p *Publisher) next(messages <-chan broker.Message) (batch []kafkago.Message, open bool) {
+	size := p.transport.BatchSize
+	if size < 1 {
+		size = 1
+	}
+	var linger <-chan time.Time
+
+	for len(batch) < size {
+		var msg broker.Message
+		select {
+		case msg, open = <-messages:
+			if !open {
+				return batch, false
+			}
+		case <-linger:
+			return batch, true
+		case <-p.ctx.Done():
+			return batch, false
+		}
+
+		if msg.Key == "" {
+			msg.Key = p.RoutingKey
+		}
+		batch = append(batch, message(msg, time.Now()))
+		if linger == nil {
+			linger = time.After(p.transport.BatchLinger)
+		}
+	}
+	return batch, true
+}
+
+// write writes a batch, retrying those messages which fail until none do or
+// the context is done.
+func (p *Publisher) write(w Writer, batch []kafkago.Message) error {
+	delay := p.transport.RetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+	for len(batch) > 0 {
+		err := w.WriteMessages(p.ctx, batch...)
+		if err == nil {
+			return nil
+		}
+
+		if errs, ok := err.(kafkago.WriteErrors); ok && len(errs) == len(batch) {
+			var failed []kafkago.Message
+			for i, e := range errs {
+				if e != nil {
+					failed = append(failed, batch[i])
+				}
+			}
+			batch = failed
+		}
+		utils.Log("kafka: failed to write %d messages to %s, retrying in %s: %v", len(batch), p.Topic, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+		delay *= 2
+		if max := p.transport.MaxRetryDelay; max > 0 && delay > max {
+			delay = max
+		}
+	}
+	return nil
+}
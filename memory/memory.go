@@ -0,0 +1,538 @@
+// The memory package is an in-process stand-in for the AMQP broker, used to
+// exercise workers, outputs and handlers in tests without a RabbitMQ server.
+//
+// It models the topology which the amqp package declares: a fanout exchange
+// per event type (or a topic or direct exchange, for routed outputs), and
+// for each analytic an x-random sharded exchange feeding one queue per
+// consumer, with messages that expire (or cannot be routed) dead-lettered
+// through "<name>-dlx" onto "<name>-dlq".
+
+package memory
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+var (
+	_ broker.Transport = (*Broker)(nil)
+	_ broker.Publisher = (*Publisher)(nil)
+	_ broker.Consumer  = (*Consumer)(nil)
+)
+
+type message struct {
+	body      []byte
+	key       string
+	env       broker.Envelope
+	published time.Time
+	enqueued  time.Time
+}
+
+// binding routes messages to a queue or exchange. On topic and direct
+// exchanges, only those with a routing key matching key.
+type binding struct {
+	name string
+	key  string
+}
+
+type exchange struct {
+	kind      string
+	alternate string
+	queues    []binding
+	exchanges []binding
+}
+
+type queue struct {
+	name  string
+	ttl   time.Duration
+	dlx   string
+	msgs  []message
+	ready chan struct{}
+}
+
+// signal wakes a consumer waiting on the queue, if there is one.
+func (q *queue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+type Broker struct {
+	// Time a message may wait on a sharded consumer queue before it is
+	// dead-lettered, as x-message-ttl does for AMQP.
+	MessageTTL time.Duration
+
+	mu        sync.Mutex
+	exchanges map[string]*exchange
+	queues    map[string]*queue
+	rand      *rand.Rand
+	seq       int
+}
+
+func NewBroker() *Broker {
+	b := new(Broker)
+	b.MessageTTL = 10 * time.Second
+	b.exchanges = make(map[string]*exchange)
+	b.queues = make(map[string]*queue)
+	b.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	return b
+}
+
+func (b *Broker) Name() string {
+	return "memory"
+}
+
+func (b *Broker) declareExchange(name string, kind string, alternate string) *exchange {
+	ex, ok := b.exchanges[name]
+	if !ok {
+		ex = &exchange{kind: kind, alternate: alternate}
+		b.exchanges[name] = ex
+	}
+	return ex
+}
+
+func (b *Broker) declareQueue(name string, ttl time.Duration, dlx string) *queue {
+	q, ok := b.queues[name]
+	if !ok {
+		q = &queue{name: name, ttl: ttl, dlx: dlx, ready: make(chan struct{}, 1)}
+		b.queues[name] = q
+	}
+	return q
+}
+
+func bind(bindings []binding, name string, key string) []binding {
+	for _, b := range bindings {
+		if b.name == name && b.key == key {
+			return bindings
+		}
+	}
+	return append(bindings, binding{name, key})
+}
+
+func unbind(bindings []binding, name string) []binding {
+	kept := bindings[:0:0]
+	for _, b := range bindings {
+		if b.name != name {
+			kept = append(kept, b)
+		}
+	}
+	return kept
+}
+
+// DeclareQueue declares a queue bound to a fanout exchange, so that tests can
+// capture what is published to the exchange and read it back with Get.
+func (b *Broker) DeclareQueue(name string, exch string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ex := b.declareExchange(exch, "fanout", "")
+	b.declareQueue(name, 0, "")
+	ex.queues = bind(ex.queues, name, "")
+}
+
+// BindQueue declares a queue bound to a topic exchange with a binding key,
+// which may use the "*" and "#" wildcards.
+func (b *Broker) BindQueue(name string, exch string, key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ex := b.declareExchange(exch, "topic", "")
+	b.declareQueue(name, 0, "")
+	ex.queues = bind(ex.queues, name, key)
+}
+
+// Publish routes a message to an exchange. Messages published to an exchange
+// which does not exist, or has nothing bound to it, are dropped.
+func (b *Broker) Publish(exch string, body []byte) {
+	b.PublishWithKey(exch, "", body)
+}
+
+// As Publish, with a routing key for topic and direct exchanges.
+func (b *Broker) PublishWithKey(exch string, key string, body []byte) {
+	b.PublishMessage(exch, broker.Message{Body: body, Key: key})
+}
+
+// As Publish, for a message with its routing key and envelope.
+func (b *Broker) PublishMessage(exch string, msg broker.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.route(exch, message{body: msg.Body, key: msg.Key, env: msg.Envelope, published: now})
+}
+
+// Get removes the message at the head of a queue, dead-lettering any which
+// have expired first.
+func (b *Broker) Get(name string) ([]byte, bool) {
+	b.mu.Lock()
+	q, ok := b.queues[name]
+	b.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	m, ok := b.pop(q)
+	return m.body, ok
+}
+
+// Depth returns the number of messages waiting on a queue.
+func (b *Broker) Depth(name string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		return 0
+	}
+	b.expire(q, time.Now())
+	return len(q.msgs)
+}
+
+// Bindings returns the number of queues and exchanges bound to an exchange.
+func (b *Broker) Bindings(exch string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ex, ok := b.exchanges[exch]
+	if !ok {
+		return 0
+	}
+	return len(ex.queues) + len(ex.exchanges)
+}
+
+// route must be called with the lock held.
+func (b *Broker) route(name string, m message) {
+	ex, ok := b.exchanges[name]
+	if !ok {
+		return
+	}
+
+	switch ex.kind {
+	case "x-random":
+		if len(ex.queues) == 0 {
+			if ex.alternate != "" {
+				b.route(ex.alternate, m)
+			}
+			return
+		}
+		b.enqueue(b.queues[ex.queues[b.rand.Intn(len(ex.queues))].name], m)
+
+	default:
+		// Each destination receives a message once, however many of its
+		// bindings match
+		seen := make(map[string]bool)
+		for _, q := range ex.queues {
+			if !seen["q:"+q.name] && ex.matches(q.key, m.key) {
+				seen["q:"+q.name] = true
+				b.enqueue(b.queues[q.name], m)
+			}
+		}
+		for _, e := range ex.exchanges {
+			if !seen["e:"+e.name] && ex.matches(e.key, m.key) {
+				seen["e:"+e.name] = true
+				b.route(e.name, m)
+			}
+		}
+	}
+}
+
+// matches reports whether a message with the routing key is routed over a
+// binding with the binding key.
+func (ex *exchange) matches(binding string, key string) bool {
+	switch ex.kind {
+	case "direct":
+		return binding == key
+	case "topic":
+		return topicMatch(strings.Split(binding, "."), strings.Split(key, "."))
+	default:
+		return true
+	}
+}
+
+// topicMatch matches dot separated words of a routing key against a binding
+// key, where "*" matches one word and "#" matches zero or more.
+func topicMatch(pattern []string, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatch(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatch(pattern[1:], words[1:])
+	}
+}
+
+// enqueue must be called with the lock held.
+func (b *Broker) enqueue(q *queue, m message) {
+	m.enqueued = time.Now()
+	q.msgs = append(q.msgs, m)
+	b.expire(q, m.enqueued)
+	q.signal()
+}
+
+// expire dead-letters messages at the head of the queue which have outlived
+// its TTL. It must be called with the lock held.
+func (b *Broker) expire(q *queue, now time.Time) {
+	if q.ttl <= 0 {
+		return
+	}
+	for len(q.msgs) > 0 && now.Sub(q.msgs[0].enqueued) >= q.ttl {
+		m := q.msgs[0]
+		q.msgs = q.msgs[1:]
+		b.deadLetter(q, m)
+	}
+}
+
+// deadLetter routes a message to the queue's dead letter exchange with the
+// empty routing key, as amqp consumers arrange with
+// x-dead-letter-routing-key. It must be called with the lock held.
+func (b *Broker) deadLetter(q *queue, m message) {
+	if q.dlx == "" {
+		return
+	}
+	m.key = ""
+	b.route(q.dlx, m)
+}
+
+func (b *Broker) pop(q *queue) (message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire(q, time.Now())
+	if len(q.msgs) == 0 {
+		return message{}, false
+	}
+	m := q.msgs[0]
+	q.msgs = q.msgs[1:]
+	if len(q.msgs) > 0 {
+		// let another consumer of the queue in
+		q.signal()
+	}
+	return m, true
+}
+
+// delivery is a message taken from a queue, held until it is settled
+type delivery struct {
+	broker *Broker
+	queue  *queue
+	msg    message
+}
+
+func (d *delivery) Body() []byte {
+	return d.msg.body
+}
+
+func (d *delivery) Timestamp() time.Time {
+	return d.msg.published
+}
+
+func (d *delivery) Envelope() broker.Envelope {
+	return d.msg.env
+}
+
+func (d *delivery) Key() string {
+	return d.msg.key
+}
+
+func (d *delivery) Ack() error {
+	return nil
+}
+
+// Nack puts the message back at the head of its queue
+func (d *delivery) Nack() error {
+	b := d.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d.queue.msgs = append([]message{d.msg}, d.queue.msgs...)
+	d.queue.signal()
+	return nil
+}
+
+// Reject dead-letters the message, or drops it if the queue has no dead
+// letter exchange
+func (d *delivery) Reject() error {
+	b := d.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.deadLetter(d.queue, d.msg)
+	return nil
+}
+
+type Publisher struct {
+	broker   *Broker
+	exchange string
+	key      string
+	ctx      context.Context
+}
+
+// Return a new object that can be used to publish to a fanout exchange, or
+// to a topic exchange for an endpoint with a routing key.
+func (b *Broker) NewPublisher(ctx context.Context, endpoint string) broker.Publisher {
+	exch, key, routed := broker.SplitEndpoint(endpoint)
+	kind := "fanout"
+	if routed {
+		kind = "topic"
+	}
+
+	b.mu.Lock()
+	b.declareExchange(exch, kind, "")
+	b.mu.Unlock()
+
+	return &Publisher{broker: b, exchange: exch, key: key, ctx: ctx}
+}
+
+func (p *Publisher) Publish(messages <-chan broker.Message) error {
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			if msg.Key == "" {
+				msg.Key = p.key
+			}
+			p.broker.PublishMessage(p.exchange, msg)
+		case <-p.ctx.Done():
+			return nil
+		}
+	}
+}
+
+type Consumer struct {
+	QueueName       string
+	DLQName         string
+	ShardedExchange string
+
+	broker *Broker
+}
+
+// NewConsumer returns a sharded consumer, declared and bound in the same way
+// as amqp.NewShardedConsumer. The queue is declared immediately, so messages
+// published after NewConsumer returns are held for the consumer. An input
+// "exchange/keys" binds to a topic exchange with each of the comma separated
+// keys, or with "#" if there are none.
+func (b *Broker) NewConsumer(ctx context.Context, name string, input string) broker.Consumer {
+	exch, filter, routed := broker.SplitEndpoint(input)
+	kind := "fanout"
+	keys := []string{""}
+	if routed {
+		kind = "topic"
+		keys = []string{"#"}
+		if filter != "" {
+			keys = strings.Split(filter, ",")
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	c := &Consumer{
+		QueueName:       fmt.Sprintf("%s-%d", name, b.seq),
+		DLQName:         fmt.Sprintf("%s-dlq", name),
+		ShardedExchange: name,
+		broker:          b,
+	}
+	dlx := fmt.Sprintf("%s-dlx", name)
+
+	source := b.declareExchange(exch, kind, "")
+	sharded := b.declareExchange(name, "x-random", dlx)
+	for _, key := range keys {
+		source.exchanges = bind(source.exchanges, name, key)
+	}
+
+	b.declareQueue(c.QueueName, b.MessageTTL, dlx)
+	sharded.queues = bind(sharded.queues, c.QueueName, "")
+
+	dlExchange := b.declareExchange(dlx, "direct", "")
+	b.declareQueue(c.DLQName, 0, "")
+	dlExchange.queues = bind(dlExchange.queues, c.DLQName, "")
+	// Unroutable messages keep their own key on the way to the DLX
+	for _, key := range keys {
+		if !strings.ContainsAny(key, "*#") {
+			dlExchange.queues = bind(dlExchange.queues, c.DLQName, key)
+		}
+	}
+
+	return c
+}
+
+// Consume delivers messages from the consumer's queue and the shared DLQ
+// until ctx is done. The queue is then unbound and anything left on it is
+// dead-lettered, as would happen when an abandoned AMQP queue expires.
+func (c *Consumer) Consume(ctx context.Context, handle func(broker.Delivery)) error {
+	b := c.broker
+
+	b.mu.Lock()
+	q := b.queues[c.QueueName]
+	dlq := b.queues[c.DLQName]
+	b.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, q := range []*queue{q, dlq} {
+		wg.Add(1)
+		go func(q *queue) {
+			defer wg.Done()
+			c.consumeQ(ctx, q, handle)
+		}(q)
+	}
+	wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ex, ok := b.exchanges[c.ShardedExchange]; ok {
+		ex.queues = unbind(ex.queues, c.QueueName)
+	}
+	for _, m := range q.msgs {
+		b.deadLetter(q, m)
+	}
+	q.msgs = nil
+	delete(b.queues, c.QueueName)
+
+	return nil
+}
+
+func (c *Consumer) consumeQ(ctx context.Context, q *queue, handle func(broker.Delivery)) {
+	// Wake periodically so that messages expire even when nothing new arrives
+	poll := time.Second
+	if q.ttl > 0 && q.ttl < poll {
+		poll = q.ttl
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if m, ok := c.broker.pop(q); ok {
+			handle(&delivery{broker: c.broker, queue: q, msg: m})
+			continue
+		}
+		select {
+		case <-q.ready:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
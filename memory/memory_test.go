@@ -0,0 +1,234 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+// collector records the messages handed to a consumer
+type collector struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (c *collector) handle(d broker.Delivery) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, string(d.Body()))
+	d.Ack()
+}
+
+func (c *collector) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.msgs)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for messages")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFanout(t *testing.T) {
+	b := NewBroker()
+	b.DeclareQueue("q1", "event")
+	b.DeclareQueue("q2", "event")
+
+	b.Publish("event", []byte("hello"))
+	b.Publish("nowhere", []byte("dropped"))
+
+	for _, q := range []string{"q1", "q2"} {
+		msg, ok := b.Get(q)
+		if !ok || string(msg) != "hello" {
+			t.Errorf("%s: got %q, expected \"hello\"", q, msg)
+		}
+		if _, ok := b.Get(q); ok {
+			t.Errorf("%s: unexpected second message", q)
+		}
+	}
+}
+
+func TestShardedConsumers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := NewBroker()
+	b.DeclareQueue("audit", "event")
+
+	var shards [3]collector
+	for i := range shards {
+		c := b.NewConsumer(ctx, "analytics-test", "event")
+		go c.Consume(ctx, shards[i].handle)
+	}
+
+	const n = 300
+	for i := 0; i < n; i++ {
+		b.Publish("event", []byte(fmt.Sprintf("msg-%d", i)))
+	}
+
+	total := func() int {
+		return shards[0].count() + shards[1].count() + shards[2].count()
+	}
+	waitFor(t, func() bool { return total() == n })
+
+	for i := range shards {
+		if shards[i].count() == 0 {
+			t.Errorf("shard %d received no messages", i)
+		}
+	}
+	if d := b.Depth("audit"); d != n {
+		t.Errorf("fanout queue has %d messages, expected %d", d, n)
+	}
+}
+
+func TestDeadLetterUnroutable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	b := NewBroker()
+	c := b.NewConsumer(ctx, "analytics-test", "event").(*Consumer)
+
+	// Once the only consumer goes away its queue is unbound, leaving the
+	// sharded exchange to use its alternate exchange
+	cancel()
+	c.Consume(ctx, func(broker.Delivery) {})
+
+	b.Publish("event", []byte("orphan"))
+
+	msg, ok := b.Get("analytics-test-dlq")
+	if !ok || string(msg) != "orphan" {
+		t.Errorf("got %q, expected \"orphan\" on the DLQ", msg)
+	}
+}
+
+func TestDeadLetterExpired(t *testing.T) {
+	b := NewBroker()
+	b.MessageTTL = 20 * time.Millisecond
+	c := b.NewConsumer(context.Background(), "analytics-test", "event").(*Consumer)
+
+	b.Publish("event", []byte("slow"))
+	if d := b.Depth(c.QueueName); d != 1 {
+		t.Fatalf("queue has %d messages, expected 1", d)
+	}
+
+	time.Sleep(2 * b.MessageTTL)
+
+	if d := b.Depth(c.QueueName); d != 0 {
+		t.Errorf("queue has %d messages after TTL, expected 0", d)
+	}
+	if d := b.Depth(c.DLQName); d != 1 {
+		t.Errorf("DLQ has %d messages, expected 1", d)
+	}
+}
+
+func TestNackAndReject(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := NewBroker()
+	c := b.NewConsumer(ctx, "analytics-test", "event")
+
+	handled := make(chan string, 10)
+	nacked := false
+	go c.Consume(ctx, func(d broker.Delivery) {
+		body := string(d.Body())
+		handled <- body
+		switch {
+		case body == "flaky" && !nacked:
+			nacked = true
+			d.Nack()
+		case body == "poison":
+			d.Reject()
+		default:
+			d.Ack()
+		}
+	})
+
+	b.Publish("event", []byte("flaky"))
+	b.Publish("event", []byte("poison"))
+
+	// The nacked message is redelivered; the rejected one is dead-lettered
+	// and handled again from the DLQ, where a second rejection drops it
+	for _, expected := range []string{"flaky", "flaky", "poison", "poison"} {
+		select {
+		case got := <-handled:
+			if got != expected {
+				t.Errorf("got %q, expected %q", got, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for delivery")
+		}
+	}
+	select {
+	case got := <-handled:
+		t.Errorf("unexpected delivery of %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTopicRouting(t *testing.T) {
+	b := NewBroker()
+	b.BindQueue("all", "events", "#")
+	b.BindQueue("dns", "events", "dns_message")
+	b.BindQueue("http", "events", "http.*")
+
+	b.PublishWithKey("events", "dns_message", []byte("dns"))
+	b.PublishWithKey("events", "http.request", []byte("request"))
+	b.PublishWithKey("events", "http.response.body", []byte("body"))
+
+	for _, test := range []struct {
+		queue    string
+		expected []string
+	}{
+		{"all", []string{"dns", "request", "body"}},
+		{"dns", []string{"dns"}},
+		{"http", []string{"request"}},
+	} {
+		var got []string
+		for {
+			msg, ok := b.Get(test.queue)
+			if !ok {
+				break
+			}
+			got = append(got, string(msg))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.queue, got, test.expected)
+		}
+	}
+}
+
+func TestConsumerFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := NewBroker()
+	c := b.NewConsumer(ctx, "analytics-dns", "events/dns_message").(*Consumer)
+
+	b.PublishWithKey("events", "http_request", []byte("http"))
+	b.PublishWithKey("events", "dns_message", []byte("dns"))
+
+	if d := b.Depth(c.QueueName); d != 1 {
+		t.Fatalf("queue has %d messages, expected 1", d)
+	}
+	if msg, _ := b.Get(c.QueueName); string(msg) != "dns" {
+		t.Errorf("got %q, expected \"dns\"", msg)
+	}
+
+	// Without a replica, matching messages still reach the DLQ
+	cancel()
+	c.Consume(ctx, func(broker.Delivery) {})
+	b.PublishWithKey("events", "dns_message", []byte("orphan"))
+	if msg, _ := b.Get(c.DLQName); string(msg) != "orphan" {
+		t.Errorf("got %q, expected \"orphan\" on the DLQ", msg)
+	}
+}
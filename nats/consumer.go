@@ -0,0 +1,164 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Consumer is a durable JetStream consumer of an exchange's stream.
+type Consumer struct {
+	Exchange string
+	// Durable consumer name, shared by every instance of the analytic
+	Durable string
+	// Subjects received, the whole stream if none
+	Subjects []string
+
+	transport *Transport
+	// Bounds the lifetime of the connection, which outlives Consume so
+	// that deliveries can still be settled
+	ctx context.Context
+	err error
+}
+
+// Return a durable consumer named name of the exchange named by input,
+// "exchange" or "exchange/filter" to receive only the subjects matching the
+// filter.
+func (t *Transport) NewConsumer(ctx context.Context, name string, input string) broker.Consumer {
+	exchange, _, _ := broker.SplitEndpoint(input)
+	subjects, err := filterSubjects(input)
+	return &Consumer{
+		Exchange:  exchange,
+		Durable:   strings.NewReplacer(".", "_", "*", "_", ">", "_").Replace(name),
+		Subjects:  subjects,
+		transport: t,
+		ctx:       ctx,
+		err:       err,
+	}
+}
+
+// Consume passes messages to handle until ctx is done, or returns an error
+// if the connection closes or consuming stops by itself, as when the
+// consumer is deleted. Each message must be acknowledged within the
+// transport's AckWait, or it is delivered again.
+func (c *Consumer) Consume(ctx context.Context, handle func(broker.Delivery)) error {
+	if c.err != nil {
+		return c.err
+	}
+
+	nc, js, err := c.transport.connect(ctx, c.Exchange)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	closed := nc.StatusChanged(natsgo.CLOSED)
+	go func() {
+		<-c.ctx.Done()
+		nc.Close()
+	}()
+
+	cons, err := js.CreateOrUpdateConsumer(ctx, streamName(c.Exchange), jetstream.ConsumerConfig{
+		Durable:        c.Durable,
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		AckWait:        c.transport.AckWait,
+		MaxAckPending:  c.transport.MaxAckPending,
+		FilterSubjects: c.Subjects,
+	})
+	if err != nil {
+		return fmt.Errorf("nats: cannot create consumer %s of %s: %v", c.Durable, c.Exchange, err)
+	}
+
+	// The last error consuming, which stopped it if it stops by itself
+	var mu sync.Mutex
+	var lastErr error
+	onErr := func(_ jetstream.ConsumeContext, err error) {
+		utils.Log("nats: error consuming from %s: %v", c.Exchange, err)
+		mu.Lock()
+		lastErr = err
+		mu.Unlock()
+	}
+
+	cc, err := cons.Consume(func(msg jetstream.Msg) {
+		d := &delivery{msg: msg, env: envelope(msg.Headers())}
+		d.key = strings.TrimPrefix(msg.Subject(), c.Exchange+".")
+		if d.key == msg.Subject() {
+			d.key = ""
+		}
+		if md, err := msg.Metadata(); err == nil {
+			d.ts = md.Timestamp
+		}
+		handle(d)
+	}, jetstream.ConsumeErrHandler(onErr))
+	if err != nil {
+		return fmt.Errorf("nats: cannot consume from %s: %v", c.Exchange, err)
+	}
+	utils.Log("nats: subscribed to events from: %s", c.Exchange)
+
+	select {
+	case <-ctx.Done():
+		cc.Stop()
+		<-cc.Closed()
+		return nil
+	case <-closed:
+		cc.Stop()
+		if ctx.Err() != nil || c.ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("nats: connection consuming from %s closed: %v", c.Exchange, nc.LastError())
+	case <-cc.Closed():
+		if ctx.Err() != nil || c.ctx.Err() != nil {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return fmt.Errorf("nats: consuming from %s stopped: %v", c.Exchange, lastErr)
+	}
+}
+
+type delivery struct {
+	msg jetstream.Msg
+	env broker.Envelope
+	// The routing key, the subject beneath the exchange
+	key string
+	// When the message was stored on the stream
+	ts time.Time
+}
+
+func (d *delivery) Body() []byte {
+	return d.msg.Data()
+}
+
+func (d *delivery) Timestamp() time.Time {
+	return d.ts
+}
+
+func (d *delivery) Envelope() broker.Envelope {
+	return d.env
+}
+
+func (d *delivery) Key() string {
+	return d.key
+}
+
+func (d *delivery) Ack() error {
+	return d.msg.Ack()
+}
+
+func (d *delivery) Nack() error {
+	return d.msg.Nak()
+}
+
+// Reject stops the message being delivered again. JetStream has no dead
+// letter queue, but publishes an advisory for each message terminated.
+func (d *delivery) Reject() error {
+	return d.msg.TermWithReason("rejected")
+}
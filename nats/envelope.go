@@ -0,0 +1,29 @@
+package nats
+
+import (
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+// message returns the NATS message for a message published to an exchange,
+// routed by its key or else the default key.
+func message(exchange string, key string, msg broker.Message) *natsgo.Msg {
+	if msg.Key != "" {
+		key = msg.Key
+	}
+	out := natsgo.NewMsg(subject(exchange, key))
+	out.Data = msg.Body
+	msg.SetHeaders(out.Header.Set)
+	// JetStream discards messages with an ID it has stored already, so
+	// messages published again after a failure are stored only once
+	if msg.MessageID != "" {
+		out.Header.Set(jetstream.MsgIDHeader, msg.MessageID)
+	}
+	return out
+}
+
+// envelope reads the envelope of a received message.
+func envelope(headers natsgo.Header) broker.Envelope {
+	return broker.EnvelopeFromHeaders(headers.Get)
+}
@@ -0,0 +1,190 @@
+// The nats package implements broker.Transport on NATS JetStream, for
+// lightweight analytics such as alert fan-out which are better served by
+// NATS than by durable RabbitMQ queues.
+//
+// Each exchange named by an output endpoint or worker input is a stream,
+// holding the subject of the same name and those beneath it. Messages are
+// published on the subject "exchange.key", or "exchange" if they have no
+// routing key, and consumers of an input "exchange/filter" receive the
+// subjects matching each of the comma separated keys in the filter, "*"
+// and "#" being wildcards as in AMQP topics. Each group of consumers sharing
+// the work, analytics-<Pgm> for a worker, is a durable consumer
+// acknowledging each message explicitly.
+
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+var (
+	_ broker.Transport = (*Transport)(nil)
+	_ broker.Publisher = (*Publisher)(nil)
+	_ broker.Consumer  = (*Consumer)(nil)
+)
+
+func init() {
+	broker.RegisterTransport("nats", transportFromEnv)
+}
+
+// transportFromEnv returns a transport for the server NATS_URL, or nil if it
+// is not set.
+func transportFromEnv() broker.Transport {
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		return nil
+	}
+	return NewTransport(url)
+}
+
+// Transport creates publishers and durable consumers, all connected to the
+// same NATS server or cluster.
+type Transport struct {
+	URL string
+
+	// Maximum number of publishes per publisher awaiting acknowledgement
+	MaxInFlight int
+	// Maximum number of deliveries per consumer awaiting acknowledgement,
+	// and how long the server waits for one before delivering it again
+	MaxAckPending int
+	AckWait       time.Duration
+	// Age beyond which the streams this creates discard messages, never if 0
+	MaxAge time.Duration
+
+	// Delay before retrying to set up a stream, doubling up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// Defaults for new transports
+const (
+	DefaultMaxInFlight   = 256
+	DefaultMaxAckPending = 1000
+	DefaultAckWait       = 30 * time.Second
+	DefaultRetryDelay    = 100 * time.Millisecond
+	DefaultMaxRetryDelay = 30 * time.Second
+)
+
+// Return a transport for the server URL, as given by NATS_URL.
+func NewTransport(url string) *Transport {
+	return &Transport{
+		URL:           url,
+		MaxInFlight:   DefaultMaxInFlight,
+		MaxAckPending: DefaultMaxAckPending,
+		AckWait:       DefaultAckWait,
+		RetryDelay:    DefaultRetryDelay,
+		MaxRetryDelay: DefaultMaxRetryDelay,
+	}
+}
+
+func (t *Transport) Name() string {
+	return "nats"
+}
+
+// streamName returns the name of an exchange's stream. Stream names cannot
+// contain the characters which separate and match subject tokens.
+func streamName(exchange string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_", "/", "_", "\\", "_").Replace(exchange)
+}
+
+// subject returns the subject a message with the routing key is published
+// on.
+func subject(exchange string, key string) string {
+	if key == "" {
+		return exchange
+	}
+	return exchange + "." + key
+}
+
+// filterSubjects returns the subjects a consumer of an input receives,
+// none meaning the whole stream.
+func filterSubjects(input string) ([]string, error) {
+	exchange, filter, _ := broker.SplitEndpoint(input)
+	if filter == "" || filter == "#" {
+		return nil, nil
+	}
+
+	var subjects []string
+	for _, key := range strings.Split(filter, ",") {
+		tokens := strings.Split(key, ".")
+		for i, tok := range tokens {
+			if tok != "#" {
+				continue
+			}
+			// NATS only matches many tokens at the end of a subject
+			if i != len(tokens)-1 {
+				return nil, fmt.Errorf("nats: cannot filter %s by %q, # is only supported as the last word", exchange, key)
+			}
+			tokens[i] = ">"
+		}
+		subjects = append(subjects, subject(exchange, strings.Join(tokens, ".")))
+	}
+	return subjects, nil
+}
+
+func (t *Transport) retryDelay() time.Duration {
+	if t.RetryDelay <= 0 {
+		return DefaultRetryDelay
+	}
+	return t.RetryDelay
+}
+
+// connect connects to the server and creates the exchange's stream if it
+// is missing, retrying until it succeeds or ctx is done. A stream which
+// already exists is left as the operator configured it. The connection reconnects by
+// itself once established.
+func (t *Transport) connect(ctx context.Context, exchange string) (*natsgo.Conn, jetstream.JetStream, error) {
+	nc, err := natsgo.Connect(t.URL,
+		natsgo.Name(fmt.Sprintf("analytics %s", exchange)),
+		natsgo.MaxReconnects(-1),
+		natsgo.RetryOnFailedConnect(true),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	max := t.MaxInFlight
+	if max < 1 {
+		max = 1
+	}
+	js, err := jetstream.New(nc, jetstream.WithPublishAsyncMaxPending(max))
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+
+	cfg := jetstream.StreamConfig{
+		Name:     streamName(exchange),
+		Subjects: []string{exchange, exchange + ".>"},
+		MaxAge:   t.MaxAge,
+	}
+	delay := t.retryDelay()
+	for {
+		_, err := js.CreateStream(ctx, cfg)
+		if err == nil || errors.Is(err, jetstream.ErrStreamNameAlreadyInUse) {
+			return nc, js, nil
+		}
+		utils.Log("nats: cannot set up stream %s, retrying in %s: %v", cfg.Name, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			nc.Close()
+			return nil, nil, ctx.Err()
+		}
+		delay *= 2
+		if max := t.MaxRetryDelay; max > 0 && delay > max {
+			delay = max
+		}
+	}
+}
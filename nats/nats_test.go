@@ -0,0 +1,270 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	natstest "github.com/nats-io/nats-server/v2/test"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+// jetStream returns the URL of a JetStream server and an exchange of the
+// test's own, whose stream is deleted afterwards. The server runs in the
+// test, storing its streams in a temporary directory, unless NATS_TEST_URL
+// names one, such as nats://localhost:4222.
+func jetStream(t *testing.T) (string, string) {
+	url := os.Getenv("NATS_TEST_URL")
+	if url == "" {
+		opts := natstest.DefaultTestOptions
+		opts.Port = -1
+		opts.JetStream = true
+		opts.StoreDir = t.TempDir()
+		srv := natstest.RunServer(&opts)
+		t.Cleanup(srv.Shutdown)
+		url = srv.ClientURL()
+	}
+	exchange := fmt.Sprintf("alerts%d", time.Now().UnixNano())
+
+	t.Cleanup(func() {
+		nc, err := natsgo.Connect(url)
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+		js, err := jetstream.New(nc)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		js.DeleteStream(ctx, streamName(exchange))
+	})
+	return url, exchange
+}
+
+func publish(t *testing.T, tr *Transport, endpoint string, msgs ...broker.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ch := make(chan broker.Message, len(msgs))
+	for _, msg := range msgs {
+		ch <- msg
+	}
+	close(ch)
+	if err := tr.NewPublisher(ctx, endpoint).Publish(ch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func consume(ctx context.Context, tr *Transport, name string, input string) <-chan broker.Delivery {
+	ch := make(chan broker.Delivery, 10)
+	c := tr.NewConsumer(ctx, name, input)
+	go c.Consume(ctx, func(d broker.Delivery) { ch <- d })
+	return ch
+}
+
+func next(t *testing.T, ch <-chan broker.Delivery) broker.Delivery {
+	select {
+	case d := <-ch:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for delivery")
+		return nil
+	}
+}
+
+func TestFilterSubjects(t *testing.T) {
+	for input, expected := range map[string]string{
+		"alerts":               "[]",
+		"alerts/":              "[]",
+		"alerts/#":             "[]",
+		"alerts/high":          "[alerts.high]",
+		"alerts/high,low":      "[alerts.high alerts.low]",
+		"alerts/*.dns_message": "[alerts.*.dns_message]",
+		"alerts/high.#":        "[alerts.high.>]",
+	} {
+		subjects, err := filterSubjects(input)
+		if err != nil {
+			t.Errorf("%s: %v", input, err)
+		}
+		if fmt.Sprint(subjects) != expected {
+			t.Errorf("%s: got subjects %v, expected %s", input, subjects, expected)
+		}
+	}
+
+	if _, err := filterSubjects("alerts/#.high"); err == nil {
+		t.Error("accepted # before the last word, which NATS cannot match")
+	}
+	if got := streamName("worker.alerts"); got != "worker_alerts" {
+		t.Errorf("got stream name %q", got)
+	}
+}
+
+func TestEnvelopeHeaders(t *testing.T) {
+	env := broker.Envelope{
+		ContentType:   "application/json",
+		SchemaVersion: "1",
+		MessageID:     "id-1",
+		CorrelationID: "id-0",
+		Origin:        "analytics-test",
+		TraceParent:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		IngestTime:    time.Unix(1500000000, 123456789),
+	}
+	msg := message("alerts", "default", broker.Message{Body: []byte("{}"), Key: "high", Envelope: env})
+	if msg.Subject != "alerts.high" {
+		t.Errorf("got subject %q, expected alerts.high", msg.Subject)
+	}
+
+	got := envelope(msg.Header)
+	if !got.IngestTime.Equal(env.IngestTime) {
+		t.Errorf("got ingest time %s, expected %s", got.IngestTime, env.IngestTime)
+	}
+	got.IngestTime = env.IngestTime
+	if got != env {
+		t.Errorf("got envelope %+v, expected %+v", got, env)
+	}
+}
+
+func TestSubjectRouting(t *testing.T) {
+	url, alerts := jetStream(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tr := NewTransport(url)
+
+	high := consume(ctx, tr, "analytics-pager", alerts+"/high")
+	all := consume(ctx, tr, "analytics-archive", alerts)
+
+	publish(t, tr, alerts+"/low",
+		broker.Message{Body: []byte("disk filling")},
+		broker.Message{Body: []byte("intrusion"), Key: "high"},
+	)
+
+	// The filtered consumer only receives alerts published with the key high
+	d := next(t, high)
+	if string(d.Body()) != "intrusion" || d.Timestamp().IsZero() {
+		t.Errorf("got %q stored at %s, expected the high alert", d.Body(), d.Timestamp())
+	}
+	d.Ack()
+
+	for _, expected := range []string{"disk filling", "intrusion"} {
+		d := next(t, all)
+		if string(d.Body()) != expected {
+			t.Errorf("got %q, expected %q", d.Body(), expected)
+		}
+		d.Ack()
+	}
+}
+
+func TestDurableConsumer(t *testing.T) {
+	url, alerts := jetStream(t)
+
+	tr := NewTransport(url)
+	tr.AckWait = time.Second
+
+	// A nacked message is delivered again
+	ctx, cancel := context.WithCancel(context.Background())
+	deliveries := consume(ctx, tr, "analytics-test", alerts)
+	publish(t, tr, alerts, broker.Message{Body: []byte("a")})
+	next(t, deliveries).Nack()
+	if d := next(t, deliveries); string(d.Body()) != "a" {
+		t.Errorf("got %q, expected a again after a nack", d.Body())
+	} else {
+		d.Ack()
+	}
+
+	// One left unacknowledged is delivered to the next instance of the
+	// analytic, which resumes where the last left off
+	publish(t, tr, alerts, broker.Message{Body: []byte("b")})
+	if d := next(t, deliveries); string(d.Body()) != "b" {
+		t.Errorf("got %q, expected b", d.Body())
+	}
+	cancel()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	deliveries = consume(ctx, tr, "analytics-test", alerts)
+	if d := next(t, deliveries); string(d.Body()) != "b" {
+		t.Errorf("got %q, expected the unacknowledged b", d.Body())
+	}
+}
+
+func TestExistingStream(t *testing.T) {
+	url, alerts := jetStream(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	nc, err := natsgo.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Settings the operator gave the stream survive workers starting on it
+	_, err = js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:     streamName(alerts),
+		Subjects: []string{alerts, alerts + ".>"},
+		MaxMsgs:  100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := NewTransport(url)
+	tr.MaxAge = time.Hour
+	publish(t, tr, alerts, broker.Message{Body: []byte("a")})
+
+	stream, err := js.Stream(ctx, streamName(alerts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg := stream.CachedInfo().Config; cfg.MaxMsgs != 100 || cfg.MaxAge != 0 {
+		t.Errorf("stream was reconfigured, max msgs %d, max age %s", cfg.MaxMsgs, cfg.MaxAge)
+	}
+}
+
+func TestConsumerDeleted(t *testing.T) {
+	url, alerts := jetStream(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tr := NewTransport(url)
+	deliveries := make(chan broker.Delivery, 10)
+	exit := make(chan error, 1)
+	go func() {
+		exit <- tr.NewConsumer(ctx, "analytics-test", alerts).Consume(ctx, func(d broker.Delivery) { deliveries <- d })
+	}()
+	publish(t, tr, alerts, broker.Message{Body: []byte("a")})
+	next(t, deliveries).Ack()
+
+	// Consume returns an error rather than waiting for messages which will
+	// never come
+	nc, err := natsgo.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := js.DeleteConsumer(ctx, streamName(alerts), "analytics-test"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exit:
+		if err == nil {
+			t.Error("returned nil after the consumer was deleted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("still consuming after the consumer was deleted")
+	}
+}
@@ -0,0 +1,106 @@
+package nats
+
+import (
+	"context"
+	"time"
+
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Publisher publishes messages to an exchange's stream.
+type Publisher struct {
+	Exchange string
+	// Key for messages without one of their own
+	RoutingKey string
+
+	transport *Transport
+	ctx       context.Context
+}
+
+// Return a publisher to the exchange named by an endpoint, "exchange" or
+// "exchange/key" to give messages a default routing key.
+func (t *Transport) NewPublisher(ctx context.Context, endpoint string) broker.Publisher {
+	exchange, key, _ := broker.SplitEndpoint(endpoint)
+	return &Publisher{Exchange: exchange, RoutingKey: key, transport: t, ctx: ctx}
+}
+
+// Publish publishes messages asynchronously, with up to the transport's
+// MaxInFlight awaiting acknowledgement by the stream. Those the stream fails
+// to acknowledge are published again, so every message is delivered at
+// least once. It returns nil once the channel is closed and everything read
+// from it has been acknowledged, or an error if the publisher's context is
+// done first.
+func (p *Publisher) Publish(messages <-chan broker.Message) error {
+	nc, js, err := p.transport.connect(p.ctx, p.Exchange)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	utils.Log("nats: publishing events to: %s", p.Exchange)
+
+	max := p.transport.MaxInFlight
+	if max < 1 {
+		max = 1
+	}
+
+	// Messages to publish before reading more, and those published and
+	// awaiting acknowledgement in the order they were published
+	var queued []*natsgo.Msg
+	var pending []jetstream.PubAckFuture
+	finished := false
+
+	for {
+		for len(queued) > 0 && len(pending) < max {
+			f, err := js.PublishMsgAsync(queued[0])
+			if err != nil {
+				utils.Log("nats: cannot publish to %s, retrying: %v", p.Exchange, err)
+				select {
+				case <-time.After(p.transport.retryDelay()):
+				case <-p.ctx.Done():
+					return p.ctx.Err()
+				}
+				continue
+			}
+			pending = append(pending, f)
+			queued = queued[1:]
+		}
+
+		if finished && len(queued) == 0 && len(pending) == 0 {
+			return nil
+		}
+
+		next := messages
+		if finished || len(queued) > 0 || len(pending) >= max {
+			next = nil
+		}
+		var acked <-chan *jetstream.PubAck
+		var failed <-chan error
+		if len(pending) > 0 {
+			acked, failed = pending[0].Ok(), pending[0].Err()
+		}
+
+		select {
+		case msg, open := <-next:
+			if !open {
+				finished = true
+				break
+			}
+			queued = append(queued, message(p.Exchange, p.RoutingKey, msg))
+
+		case <-acked:
+			pending = pending[1:]
+
+		case err := <-failed:
+			utils.Log("nats: publish to %s not acknowledged, republishing: %v", p.Exchange, err)
+			queued = append(queued, pending[0].Msg())
+			pending = pending[1:]
+
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Exporter receives spans as they finish. Export is called from many
+// goroutines at once, and must not keep the span waiting.
+type Exporter interface {
+	Export(s *Span)
+}
+
+var (
+	exporterMu sync.RWMutex
+	current    Exporter = discard{}
+)
+
+// SetExporter sends finished spans to e, or discards them if e is nil.
+func SetExporter(e Exporter) {
+	if e == nil {
+		e = discard{}
+	}
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+	current = e
+}
+
+func exporter() Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+	return current
+}
+
+type discard struct{}
+
+func (discard) Export(*Span) {}
+
+// WriterExporter writes each span as a line of JSON.
+type WriterExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// Return an exporter writing to w, such as os.Stdout.
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{enc: json.NewEncoder(w)}
+}
+
+// How a span is written
+type spanJSON struct {
+	Name       string            `json:"name"`
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Start      time.Time         `json:"start"`
+	DurationNS int64             `json:"duration_ns"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+func (e *WriterExporter) Export(s *Span) {
+	out := spanJSON{
+		Name:       s.Name,
+		TraceID:    s.Context.TraceID.String(),
+		SpanID:     s.Context.SpanID.String(),
+		Start:      s.Start,
+		DurationNS: int64(s.End.Sub(s.Start)),
+		Attributes: s.Attributes,
+		Error:      s.Err,
+	}
+	if s.Parent != (SpanID{}) {
+		out.ParentID = s.Parent.String()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.enc.Encode(out)
+}
+
+// MemoryExporter keeps finished spans, for tests to inspect.
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *MemoryExporter) Export(s *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+// Spans returns the spans exported so far, in the order they finished.
+func (e *MemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
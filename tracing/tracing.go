@@ -0,0 +1,180 @@
+// The tracing package follows events through chains of analytics. Span
+// contexts travel between analytics in W3C traceparent form, as
+// OpenTelemetry does, so traces can be joined up with those of other
+// services; finished spans go to a pluggable Exporter.
+
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// Trace flag marking a trace as sampled, so its spans are exported
+const FlagSampled = 0x01
+
+// SpanContext identifies a span, and is what is passed between analytics.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	// Vendor specific trace state, passed on untouched
+	TraceState string
+}
+
+// IsValid reports whether the span context has trace and span IDs.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent returns the span context as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceparent reads a W3C traceparent header value.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, fmt.Errorf("malformed traceparent %q", s)
+	}
+	// Later versions may add fields, but version 00 has exactly four
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, fmt.Errorf("malformed traceparent %q", s)
+	}
+
+	var flags [1]byte
+	for _, f := range []struct {
+		hex string
+		dst []byte
+	}{
+		{parts[1], sc.TraceID[:]},
+		{parts[2], sc.SpanID[:]},
+		{parts[3], flags[:]},
+	} {
+		if len(f.hex) != 2*len(f.dst) {
+			return sc, fmt.Errorf("malformed traceparent %q", s)
+		}
+		if _, err := hex.Decode(f.dst, []byte(f.hex)); err != nil {
+			return sc, fmt.Errorf("malformed traceparent %q", s)
+		}
+	}
+	sc.Flags = flags[0]
+
+	if !sc.IsValid() {
+		return sc, errors.New("traceparent has an all-zero trace or span ID")
+	}
+	return sc, nil
+}
+
+// Span is an operation within a trace, such as an analytic handling one
+// event.
+type Span struct {
+	Name    string
+	Context SpanContext
+	// Parent span, zero for the root of a trace
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	// Error which ended the operation, if it failed
+	Err string
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// SetAttribute records a key/value pair describing the span.
+func (s *Span) SetAttribute(key string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// SetError records that the operation failed.
+func (s *Span) SetError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Err = err.Error()
+}
+
+// Finish ends the span, exporting it if the trace is sampled. Only the first
+// call has any effect.
+func (s *Span) Finish() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	if s.Context.Flags&FlagSampled != 0 {
+		exporter().Export(s)
+	}
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+// ContextWithRemote returns a context carrying a span context received from
+// another analytic, which spans started from it continue.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// FromContext returns the context of the span in ctx: the one most recently
+// started, or else the remote one. It is not valid if there is neither.
+func FromContext(ctx context.Context) SpanContext {
+	if s, ok := ctx.Value(spanKey).(*Span); ok {
+		return s.Context
+	}
+	sc, _ := ctx.Value(remoteKey).(SpanContext)
+	return sc
+}
+
+// Start begins a span, as a child of the span in ctx or the root of a new,
+// sampled, trace. The span must be finished with Finish.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	s := &Span{
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+	}
+
+	parent := FromContext(ctx)
+	if parent.IsValid() {
+		s.Context = parent
+		s.Parent = parent.SpanID
+	} else {
+		rand.Read(s.Context.TraceID[:])
+		s.Context.Flags = FlagSampled
+	}
+	rand.Read(s.Context.SpanID[:])
+
+	return context.WithValue(ctx, spanKey, s), s
+}
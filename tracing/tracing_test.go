@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	s := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || sc.Flags != FlagSampled {
+		t.Errorf("got span context %+v", sc)
+	}
+	if got := sc.Traceparent(); got != s {
+		t.Errorf("got traceparent %q, expected %q", got, s)
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+	} {
+		if _, err := ParseTraceparent(bad); err == nil {
+			t.Errorf("parsed malformed traceparent %q", bad)
+		}
+	}
+
+	// Later versions may have more fields
+	if _, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); err != nil {
+		t.Errorf("rejected a later version: %v", err)
+	}
+}
+
+func TestSpans(t *testing.T) {
+	exp := &MemoryExporter{}
+	SetExporter(exp)
+	defer SetExporter(nil)
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	remote.TraceState = "vendor=value"
+	ctx := ContextWithRemote(context.Background(), remote)
+
+	ctx, parent := Start(ctx, "parent")
+	_, child := Start(ctx, "child")
+	child.SetError(errors.New("failed"))
+	child.Finish()
+	child.Finish()
+	parent.Finish()
+
+	spans := exp.Spans()
+	if len(spans) != 2 || spans[0] != child || spans[1] != parent {
+		t.Fatalf("got %d spans exported, expected the child and then the parent", len(spans))
+	}
+	if parent.Context.TraceID != remote.TraceID || parent.Parent != remote.SpanID || parent.Context.TraceState != "vendor=value" {
+		t.Errorf("parent span %+v does not continue the remote trace", parent.Context)
+	}
+	if child.Context.TraceID != remote.TraceID || child.Parent != parent.Context.SpanID || child.Err != "failed" {
+		t.Errorf("got child span %+v with parent %s", child.Context, child.Parent)
+	}
+
+	// Without a parent, spans start a new sampled trace
+	_, root := Start(context.Background(), "root")
+	if !root.Context.IsValid() || root.Parent != (SpanID{}) || root.Context.Flags&FlagSampled == 0 {
+		t.Errorf("got root span %+v", root.Context)
+	}
+
+	// Spans of unsampled traces are not exported
+	remote.Flags = 0
+	_, unsampled := Start(ContextWithRemote(context.Background(), remote), "unsampled")
+	unsampled.Finish()
+	if len(exp.Spans()) != 2 {
+		t.Error("exported a span of an unsampled trace")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -34,6 +35,20 @@ func Getenv(env string, def string) string {
 	}
 }
 
+// Get integer environment variable, logging values which don't parse
+func GetenvInt(env string, def int) int {
+	s := os.Getenv(env)
+	if s == "" {
+		return def
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		Log("Couldn't parse %s: %s, using %d", env, err.Error(), def)
+		return def
+	}
+	return i
+}
+
 func ContextWithSigterm(ctx context.Context) (context.Context, func()) {
 	ctx, cncl := context.WithCancel(ctx)
 	c := make(chan os.Signal, 1)
@@ -0,0 +1,28 @@
+package webhook
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_requests",
+			Help: "number of requests made to webhooks, by response status or \"error\" if there was none",
+		},
+		[]string{"endpoint", "status"},
+	)
+
+	dropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_messages_dropped",
+			Help: "number of messages dropped after the webhook rejected them or retries were exhausted",
+		},
+		[]string{"endpoint"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requests)
+	prometheus.MustRegister(dropped)
+}
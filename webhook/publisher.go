@@ -0,0 +1,261 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/compression"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Publisher posts messages to a webhook.
+type Publisher struct {
+	URL string
+
+	transport *Transport
+	ctx       context.Context
+	// The URL without credentials, for logs and metrics
+	endpoint string
+}
+
+// Return a publisher posting to the URL given as the endpoint.
+func (t *Transport) NewPublisher(ctx context.Context, endpoint string) broker.Publisher {
+	return &Publisher{URL: endpoint, transport: t, ctx: ctx, endpoint: redact(endpoint)}
+}
+
+// Publish posts messages, in batches if the transport's BatchSize is more
+// than 1, until the channel is closed. Up to the transport's BufferSize
+// messages are read ahead while waiting for the webhook. Messages the
+// webhook rejects, or which still fail after MaxRetries retries, are logged
+// and dropped. It returns nil once the channel is closed and everything
+// read from it has been posted or dropped, or an error if the publisher's
+// context is done first.
+func (p *Publisher) Publish(messages <-chan broker.Message) error {
+	size := p.transport.BufferSize
+	if size < 1 {
+		size = 1
+	}
+	buffer := make(chan broker.Message, size)
+	go func() {
+		defer close(buffer)
+		for {
+			select {
+			case msg, open := <-messages:
+				if !open {
+					return
+				}
+				select {
+				case buffer <- msg:
+				case <-p.ctx.Done():
+					return
+				}
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	utils.Log("webhook: posting events to: %s", p.endpoint)
+
+	for {
+		batch, open := p.next(buffer)
+		if len(batch) > 0 {
+			if err := p.post(batch); err != nil {
+				return err
+			}
+		}
+		if !open {
+			return p.ctx.Err()
+		}
+	}
+}
+
+// next reads a batch of messages, waiting for the first and then up to the
+// transport's BatchLinger for the batch to fill. open is false once the
+// buffer is closed.
+func (p *Publisher) next(buffer <-chan broker.Message) (batch []broker.Message, open bool) {
+	size := p.transport.BatchSize
+	if size < 1 {
+		size = 1
+	}
+	var linger <-chan time.Time
+	for len(batch) < size {
+		var msg broker.Message
+		select {
+		case msg, open = <-buffer:
+			if !open {
+				return batch, false
+			}
+		case <-linger:
+			return batch, true
+		}
+
+		batch = append(batch, msg)
+		if linger == nil {
+			linger = time.After(p.transport.BatchLinger)
+		}
+	}
+	return batch, true
+}
+
+// payload returns the request body for a batch: the body of a lone message
+// when not batching, or else a JSON array of bodies, those which are not
+// JSON given as strings. Compressed bodies are decompressed first.
+func (p *Publisher) payload(batch []broker.Message) ([]byte, error) {
+	bodies := make([][]byte, len(batch))
+	for i, msg := range batch {
+		bodies[i] = msg.Body
+		if msg.ContentEncoding != "" {
+			body, err := compression.Decode(msg.ContentEncoding, msg.Body)
+			if err != nil {
+				return nil, err
+			}
+			bodies[i] = body
+		}
+	}
+	if p.transport.BatchSize <= 1 {
+		return bodies[0], nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, body := range bodies {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if !json.Valid(body) {
+			var err error
+			if body, err = json.Marshal(string(body)); err != nil {
+				return nil, err
+			}
+		}
+		buf.Write(body)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+// post posts a batch, retrying with backoff, and returns an error only if
+// the context is done first.
+func (p *Publisher) post(batch []broker.Message) error {
+	drop := func(err error) {
+		utils.Log("webhook: dropping %d messages to %s: %v", len(batch), p.endpoint, err)
+		dropped.With(map[string]string{"endpoint": p.endpoint}).Add(float64(len(batch)))
+	}
+
+	body, err := p.payload(batch)
+	if err != nil {
+		drop(err)
+		return nil
+	}
+
+	delay := p.transport.RetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+	for attempt := 0; ; attempt++ {
+		retry, wait, err := p.request(body, batch)
+		if err == nil {
+			return nil
+		}
+		if p.ctx.Err() != nil {
+			return p.ctx.Err()
+		}
+		if !retry || (p.transport.MaxRetries >= 0 && attempt >= p.transport.MaxRetries) {
+			drop(err)
+			return nil
+		}
+
+		// The server may say how long to wait
+		if wait <= 0 {
+			wait = delay
+		}
+		if max := p.transport.MaxRetryDelay; max > 0 && wait > max {
+			wait = max
+		}
+		utils.Log("webhook: failed to post %d messages to %s, retrying in %s: %v", len(batch), p.endpoint, wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+		delay *= 2
+		if max := p.transport.MaxRetryDelay; max > 0 && delay > max {
+			delay = max
+		}
+	}
+}
+
+// request makes a single request, returning whether it may be retried if
+// it fails, and how long the server asked to wait before doing so.
+func (p *Publisher) request(body []byte, batch []broker.Message) (retry bool, wait time.Duration, err error) {
+	req, err := http.NewRequest("POST", p.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, fmt.Errorf("malformed URL %s", p.endpoint)
+	}
+	req = req.WithContext(p.ctx)
+
+	for name, values := range p.transport.Headers {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(batch) == 1 && p.transport.BatchSize <= 1 {
+		env := batch[0].Envelope
+		if env.ContentType != "" {
+			req.Header.Set("Content-Type", env.ContentType)
+		}
+		if env.TraceParent != "" {
+			req.Header.Set("traceparent", env.TraceParent)
+		}
+		if env.TraceState != "" {
+			req.Header.Set("tracestate", env.TraceState)
+		}
+	}
+	if p.transport.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.transport.BearerToken)
+	}
+
+	client := p.transport.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		requests.With(map[string]string{"endpoint": p.endpoint, "status": "error"}).Inc()
+		// The error names the whole URL, which is logged
+		if uerr, ok := err.(*url.Error); ok {
+			err = fmt.Errorf("%s %s: %v", uerr.Op, p.endpoint, uerr.Err)
+		}
+		return true, 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	requests.With(map[string]string{"endpoint": p.endpoint, "status": strconv.Itoa(resp.StatusCode)}).Inc()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, 0, nil
+	}
+	err = fmt.Errorf("status %s", resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		if s, e := strconv.Atoi(resp.Header.Get("Retry-After")); e == nil && s > 0 {
+			wait = time.Duration(s) * time.Second
+		}
+		return true, wait, err
+	}
+	return false, 0, err
+}
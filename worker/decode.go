@@ -0,0 +1,51 @@
+package worker
+
+import (
+	"sync"
+
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/compression"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Content encodings with no codec which have been logged, each only once
+var unknownEncodings sync.Map
+
+// decoded is a delivery with its body decompressed
+type decoded struct {
+	broker.Delivery
+	body []byte
+	env  broker.Envelope
+}
+
+func (d *decoded) Body() []byte {
+	return d.body
+}
+
+func (d *decoded) Envelope() broker.Envelope {
+	return d.env
+}
+
+// decode decompresses a delivery with a content encoding, so that handlers
+// and order keys always see the original body. Deliveries whose encoding is
+// not one of the compression package's codecs, such as "utf-8" or
+// "identity" from other publishers, are passed on as they are. On error the
+// delivery is returned as it is, to be settled.
+func decode(d broker.Delivery) (broker.Delivery, error) {
+	env := d.Envelope()
+	if env.ContentEncoding == "" {
+		return d, nil
+	}
+	if _, err := compression.Lookup(env.ContentEncoding); err != nil {
+		if _, logged := unknownEncodings.LoadOrStore(env.ContentEncoding, true); !logged {
+			utils.Log("Passing on messages with content encoding %q undecoded", env.ContentEncoding)
+		}
+		return d, nil
+	}
+	body, err := compression.Decode(env.ContentEncoding, d.Body())
+	if err != nil {
+		return d, err
+	}
+	env.ContentEncoding = ""
+	return &decoded{Delivery: d, body: body, env: env}, nil
+}
@@ -0,0 +1,91 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const DefaultDrainTimeout = 20 * time.Second
+
+// drainTimeout returns DrainTimeout, or DefaultDrainTimeout if it is unset.
+func (w *QueueWorker) drainTimeout() time.Duration {
+	if w.DrainTimeout <= 0 {
+		return DefaultDrainTimeout
+	}
+	return w.DrainTimeout
+}
+
+// drain shuts the worker down once Run's context is done. It waits for the
+// consumer to stop, hands everything already delivered, and any pending
+// delivery Run had taken, to the handlers,
+// waits for the handlers to finish, and flushes the outputs. The consumer's
+// connection is closed by Run afterwards, so that acks for the handled
+// messages reach the broker. It gives up once DrainTimeout has passed.
+func (w *QueueWorker) drain(consumed chan struct{}, ch chan broker.Delivery, handlers *pool, pending broker.Delivery) error {
+	start := time.Now()
+	utils.Log("shutdown: draining worker")
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.drainTimeout())
+	defer cancel()
+
+	handled := 0
+	submit := func(d broker.Delivery) {
+		if handlers.submit(ctx, d) {
+			handled++
+		}
+	}
+
+	if pending != nil {
+		submit(pending)
+	}
+
+	// The consumer may be blocked handing over a delivery, so keep taking
+	// them until it has stopped
+Consuming:
+	for {
+		select {
+		case d := <-ch:
+			submit(d)
+		case <-consumed:
+			break Consuming
+		case <-w.notifyClose:
+			break Consuming
+		case <-ctx.Done():
+			break Consuming
+		}
+	}
+	for len(ch) > 0 && ctx.Err() == nil {
+		submit(<-ch)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		handlers.close()
+		close(finished)
+	}()
+
+	var err error
+	select {
+	case <-finished:
+		err = w.Worker.Close(ctx)
+	case <-ctx.Done():
+		err = fmt.Errorf("handlers still running")
+	}
+
+	if err == nil && ctx.Err() != nil {
+		err = fmt.Errorf("timed out")
+	}
+	if err != nil {
+		utils.Log("shutdown: drain incomplete after %s, %d buffered messages handed to handlers: %s",
+			time.Since(start), handled, err.Error())
+		return err
+	}
+
+	utils.Log("shutdown: drained in %s, %d buffered messages handled, outputs flushed",
+		time.Since(start), handled)
+	return nil
+}
@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+// Matches the scheme at the start of a URL
+var schemePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+
+// parseOutput splits an output spec, "name:endpoint".
+func parseOutput(spec string) (name string, endpoint string, err error) {
+	toks := strings.SplitN(spec, ":", 2)
+	if len(toks) != 2 {
+		return "", "", fmt.Errorf("output %q has no endpoint, expected name:endpoint", spec)
+	}
+	if toks[0] == "" {
+		return "", "", fmt.Errorf("output %q has no name, expected name:endpoint", redactEndpoint(toks[1]))
+	}
+	if toks[1] == "" {
+		return "", "", fmt.Errorf("output %s has no endpoint, expected name:endpoint", toks[0])
+	}
+	return toks[0], toks[1], nil
+}
+
+// resolve returns the transport for an output endpoint, and the endpoint
+// which its publishers take. Endpoints without a scheme, "exchange" or
+// "exchange/key", are exchanges on the active transport, and those with one
+// go to the output backend registered for it.
+func resolve(endpoint string, active broker.Transport) (broker.Transport, string, error) {
+	if endpoint == "" {
+		return nil, "", errors.New("no endpoint given")
+	}
+	if !schemePattern.MatchString(endpoint) {
+		return active, endpoint, nil
+	}
+
+	u, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, "", err
+	}
+	b, ok := broker.GetOutputBackend(u.Scheme)
+	if !ok {
+		return nil, "", fmt.Errorf("unknown endpoint scheme %q, expected one of %s",
+			u.Scheme, strings.Join(broker.OutputSchemes(), ", "))
+	}
+	return b(u, active)
+}
+
+// resolveInput returns the transport for a worker input, and the exchange
+// which its consumers take. Inputs without a scheme are exchanges on the
+// active transport, and those with one, such as "file:/path", go to the
+// input backend registered for it.
+func resolveInput(input string, active broker.Transport) (broker.Transport, string, error) {
+	if !schemePattern.MatchString(input) {
+		return active, input, nil
+	}
+
+	u, err := parseEndpoint(input)
+	if err != nil {
+		return nil, "", err
+	}
+	b, ok := broker.GetInputBackend(u.Scheme)
+	if !ok {
+		return nil, "", fmt.Errorf("unknown input scheme %q, expected one of %s",
+			u.Scheme, strings.Join(broker.InputSchemes(), ", "))
+	}
+	return b(u)
+}
+
+// parseEndpoint parses a URL, leaving it out of any error in case it has
+// credentials.
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if e, ok := err.(*url.Error); ok {
+		return nil, fmt.Errorf("malformed endpoint: %v", e.Err)
+	}
+	return u, err
+}
+
+// redactEndpoint returns an endpoint for metrics and logs. URLs naming a
+// host are cut down to their scheme and host, as webhook URLs may carry
+// credentials and tokens in their user info, path or query, and others lose
+// their query.
+func redactEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		if schemePattern.MatchString(endpoint) {
+			return "<malformed URL>"
+		}
+		return endpoint
+	}
+	if u.Host != "" {
+		return (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
@@ -0,0 +1,136 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// What QueueWorker.Run does with a message once the handler has failed on it
+// and any retries are exhausted.
+type ErrorAction int
+
+const (
+	// Log the error and acknowledge the message.
+	DropOnError ErrorAction = iota
+	// Send the raw message, with its envelope and routing key, to the
+	// output named by ErrorPolicy.Output, then acknowledge it.
+	OutputOnError
+	// Return the message to its queue and stop the worker, Run returning
+	// the handler's error.
+	StopOnError
+)
+
+// ErrorPolicy decides what happens when a handler returns an error. The zero
+// value logs and drops the message without retrying.
+type ErrorPolicy struct {
+	// Number of times the handler is called again before giving up
+	Retries int
+	// Delay before the first retry, doubling for each one after
+	Backoff time.Duration
+
+	Action ErrorAction
+	// Output receiving messages for OutputOnError
+	Output string
+}
+
+// Counters for the outcome of handler errors
+type errorCounters struct {
+	retried *prometheus.CounterVec
+	dropped *prometheus.CounterVec
+	output  *prometheus.CounterVec
+	stopped *prometheus.CounterVec
+}
+
+func newErrorCounter(name string, help string) *prometheus.CounterVec {
+	return register(name, prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: name,
+			Help: help,
+		},
+		[]string{"analytic"},
+	)).(*prometheus.CounterVec)
+}
+
+func newErrorCounters() *errorCounters {
+	return &errorCounters{
+		retried: newErrorCounter("handler_errors_retried", "number of handler calls retried after an error"),
+		dropped: newErrorCounter("handler_errors_dropped", "number of messages dropped after handler errors"),
+		output:  newErrorCounter("handler_errors_output", "number of messages sent to the error output after handler errors"),
+		stopped: newErrorCounter("handler_errors_stopped", "number of times a handler error stopped the worker"),
+	}
+}
+
+// Check the policy can be applied to the worker's outputs
+func (p ErrorPolicy) validate(w *Worker) error {
+	if p.Action != OutputOnError {
+		return nil
+	}
+	w.out.mu.RLock()
+	_, ok := w.out.outputs[p.Output]
+	w.out.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("error policy output %q is not one of the worker outputs", p.Output)
+	}
+	return nil
+}
+
+// handleError applies the worker's error policy to a delivery the handler has
+// failed on. call runs the handler again for a retry, after which settle
+// settles the delivery as if the first call had succeeded. A non-nil return
+// means the worker should stop.
+func (w *QueueWorker) handleError(ctx context.Context, d broker.Delivery, err error, call func() error, settle func()) error {
+	p := w.ErrorPolicy
+	labels := prometheus.Labels{"analytic": Pgm}
+
+	backoff := p.Backoff
+	for i := 0; i < p.Retries && err != nil; i++ {
+		utils.Log("error: Handler failed, retrying in %s: %s", backoff, err.Error())
+		w.errorCounters.retried.With(labels).Inc()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			// Leave the message for whoever consumes the queue next
+			d.Nack()
+			return nil
+		}
+		backoff *= 2
+
+		err = call()
+	}
+	if err == nil {
+		settle()
+		return nil
+	}
+
+	switch p.Action {
+	case OutputOnError:
+		utils.Log("error: Handler failed, sending message to %s: %s", p.Output, err.Error())
+		w.errorCounters.output.With(labels).Inc()
+		msg := broker.Message{Body: d.Body(), Key: d.Key(), Envelope: d.Envelope()}
+		if err := w.out.SendMessage(p.Output, msg); err != nil {
+			// Rather than losing it, leave the message on its queue
+			utils.Log("error: Failed to send message to %s: %s", p.Output, err.Error())
+			d.Nack()
+			return nil
+		}
+		d.Ack()
+
+	case StopOnError:
+		utils.Log("error: Handler failed, stopping worker: %s", err.Error())
+		w.errorCounters.stopped.With(labels).Inc()
+		d.Nack()
+		return err
+
+	default:
+		utils.Log("error: Handler failed, dropping message: %s", err.Error())
+		w.errorCounters.dropped.With(labels).Inc()
+		d.Ack()
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package worker
+
+import (
+	"encoding/json"
+)
+
+// DeviceKey is a QueueWorker OrderKey which keeps events from each device in
+// order. Messages which are not a JSON event all have the same key.
+func DeviceKey(msg []byte) string {
+	var e struct {
+		Device string `json:"device"`
+	}
+	json.Unmarshal(msg, &e)
+	return e.Device
+}
+
+// ActionKey returns the action of a JSON event, such as "dns_message" or
+// "http_request", for use as a routing key:
+//
+//	w.SendWithKey("output", ActionKey(msg), msg)
+//
+// Messages which are not a JSON event get the empty key, leaving the output
+// to route them with the key from its endpoint.
+func ActionKey(msg []byte) string {
+	var e struct {
+		Action string `json:"action"`
+	}
+	json.Unmarshal(msg, &e)
+	return e.Action
+}
@@ -1,9 +1,43 @@
 package worker
 
 import (
+	"net/http"
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+var (
+	collectorsMu sync.Mutex
+	collectors   = make(map[string]prometheus.Collector)
+
+	serveMetricsOnce sync.Once
+)
+
+// register registers a worker collector under its metric name. If the process
+// has already registered one of that name, e.g. a second worker or output
+// created in tests, the existing collector is returned instead.
+func register(name string, c prometheus.Collector) prometheus.Collector {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+
+	if existing, ok := collectors[name]; ok {
+		return existing
+	}
+	prometheus.MustRegister(c)
+	collectors[name] = c
+	return c
+}
+
+// serveMetrics exposes the registered metrics on :8080, once per process.
+func serveMetrics() {
+	serveMetricsOnce.Do(func() {
+		http.Handle("/metrics", promhttp.Handler())
+		go http.ListenAndServe(":8080", nil)
+	})
+}
+
 func RemoveCounter(c *Counter) {
 	prometheus.Unregister(c.c)
 }
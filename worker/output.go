@@ -2,16 +2,19 @@ package worker
 
 import (
 	"context"
+
+	"github.com/trustnetworks/analytics-common/broker"
 )
 
 type Output struct {
-	worker *WorkerQueue
-	name   string
+	worker    *WorkerQueue
+	name      string
+	transport broker.Transport
 }
 
 func (o *Output) Add(ctx context.Context, endpoint string) error {
 	var err error
-	o.worker, err = NewWorkerQueue(ctx, o.name, endpoint)
+	o.worker, err = NewTransportWorkerQueue(ctx, o.transport, o.name, endpoint)
 	return err
 }
 
@@ -19,3 +22,15 @@ func (o *Output) Send(msg []uint8) error {
 	err := o.worker.Send(msg)
 	return err
 }
+
+func (o *Output) SendWithKey(key string, msg []uint8) error {
+	return o.worker.SendWithKey(key, msg)
+}
+
+func (o *Output) SendMessage(msg broker.Message) error {
+	return o.worker.SendMessage(msg)
+}
+
+func (o *Output) Close(ctx context.Context) error {
+	return o.worker.Close(ctx)
+}
@@ -2,27 +2,127 @@ package worker
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/broker"
+	"github.com/trustnetworks/analytics-common/compression"
 )
 
+// OutputSet is safe for concurrent use.
 type OutputSet struct {
-	outputs map[string]*Output
+	mu         sync.RWMutex
+	outputs    map[string]*Output
+	transport  broker.Transport
+	compressor *compression.Compressor
+	// Zero for the DefaultSendTimeout
+	sendTimeout time.Duration
 }
 
 func NewOutputSet() *OutputSet {
+	return NewTransportOutputSet(defaultTransport())
+}
+
+// As NewOutputSet, but every output publishes through the given transport
+func NewTransportOutputSet(t broker.Transport) *OutputSet {
 	s := &OutputSet{}
 	s.outputs = make(map[string]*Output)
+	s.transport = t
 	return s
 }
 
+// Add an output publishing to the endpoint. Endpoints "exchange" or
+// "exchange/key" are exchanges on the set's transport. Those with a scheme
+// publish through the backend which the transport package imported for it
+// registered with broker.RegisterOutputBackend: the amqp package's
+// "amqp://exchange?routing=key", the file package's "file:///path" and
+// "stdout:", and the webhook package's "http://..." and "https://...".
 func (o *OutputSet) Add(ctx context.Context, name string, endpoint string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	t, endpoint, err := resolve(endpoint, o.transport)
+	if err != nil {
+		return fmt.Errorf("output %s: %v", name, err)
+	}
+
 	if _, ok := o.outputs[name]; !ok {
 		o.outputs[name] = &(Output{name: name})
 	}
+	o.outputs[name].transport = t
 
-	return o.outputs[name].Add(ctx, endpoint)
+	if err := o.outputs[name].Add(ctx, endpoint); err != nil {
+		return err
+	}
+	o.outputs[name].worker.SetCompression(o.compressor)
+	o.outputs[name].worker.SetSendTimeout(o.sendTimeout)
+	return nil
+}
 
+// Compress the bodies of messages sent to outputs added from now on.
+func (o *OutputSet) SetCompression(c *compression.Compressor) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.compressor = c
+}
+
+// Limit how long sending to outputs added from now on waits while they are
+// full, as when the broker blocks publishing.
+func (o *OutputSet) SetSendTimeout(d time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sendTimeout = d
 }
 
 func (o *OutputSet) Send(name string, msg []uint8) error {
-	return o.outputs[name].Send(msg)
+	return o.SendWithKey(name, "", msg)
+}
+
+// SendWithKey sends a message routed with its own key, which overrides any
+// routing key in the output's endpoint.
+func (o *OutputSet) SendWithKey(name string, key string, msg []uint8) error {
+	return o.SendMessage(name, broker.Message{Body: msg, Key: key})
+}
+
+// SendMessage sends a message with its envelope.
+func (o *OutputSet) SendMessage(name string, msg broker.Message) error {
+	o.mu.RLock()
+	out, ok := o.outputs[name]
+	o.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("no output named %q", name)
+	}
+	return out.SendMessage(msg)
+}
+
+// Close flushes every output, returning once all are flushed or ctx is done.
+func (o *OutputSet) Close(ctx context.Context) error {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+	for name, out := range o.outputs {
+		wg.Add(1)
+		go func(name string, out *Output) {
+			defer wg.Done()
+			if err := out.Close(ctx); err != nil {
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("%s: %s", name, err.Error()))
+				mu.Unlock()
+			}
+		}(name, out)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("outputs not flushed: %s", strings.Join(failed, ", "))
+	}
+	return nil
 }
@@ -0,0 +1,107 @@
+package worker
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/trustnetworks/analytics-common/broker"
+)
+
+// pool runs a handler on a number of goroutines. Without a key function all
+// goroutines share one lane; with one, each goroutine has its own lane and
+// deliveries with the same key are always handled, in order, on the same
+// goroutine.
+type pool struct {
+	lanes []chan broker.Delivery
+	key   func([]byte) string
+
+	// The first error returned by the handler, which stops the pool
+	errs chan error
+	stop chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+
+	closeOnce sync.Once
+}
+
+func newPool(n int, key func([]byte) string, handle func(broker.Delivery) error) *pool {
+	if n < 1 {
+		n = 1
+	}
+
+	p := &pool{key: key, errs: make(chan error, 1), stop: make(chan struct{})}
+
+	lanes := 1
+	if key != nil {
+		lanes = n
+	}
+	p.lanes = make([]chan broker.Delivery, lanes)
+	for i := range p.lanes {
+		p.lanes[i] = make(chan broker.Delivery)
+	}
+
+	for i := 0; i < n; i++ {
+		lane := p.lanes[i%lanes]
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for d := range lane {
+				if err := handle(d); err != nil {
+					p.fail(err)
+					return
+				}
+			}
+		}()
+	}
+
+	return p
+}
+
+func (p *pool) fail(err error) {
+	p.once.Do(func() {
+		p.errs <- err
+		close(p.stop)
+	})
+}
+
+func (p *pool) lane(d broker.Delivery) chan broker.Delivery {
+	if p.key == nil {
+		return p.lanes[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(p.key(d.Body())))
+	return p.lanes[h.Sum32()%uint32(len(p.lanes))]
+}
+
+// submit waits for a goroutine to take the delivery. It returns false, with
+// the delivery returned to its queue, if the pool has stopped or the context
+// is done first.
+func (p *pool) submit(ctx context.Context, d broker.Delivery) bool {
+	if p.offer(ctx, d) {
+		return true
+	}
+	d.Nack()
+	return false
+}
+
+// offer is submit, but leaves a delivery no goroutine took to the caller.
+func (p *pool) offer(ctx context.Context, d broker.Delivery) bool {
+	select {
+	case p.lane(d) <- d:
+		return true
+	case <-p.stop:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// close stops the pool once the in-flight deliveries have been handled.
+func (p *pool) close() {
+	p.closeOnce.Do(func() {
+		for _, lane := range p.lanes {
+			close(lane)
+		}
+	})
+	p.wg.Wait()
+}